@@ -0,0 +1,46 @@
+// omogenexec-server serves the RunnerService over gRPC.
+package main
+
+import (
+	"flag"
+	"github.com/google/logger"
+	apipb "github.com/jsannemo/omogenexec/api"
+	"github.com/jsannemo/omogenexec/eval"
+	"github.com/jsannemo/omogenexec/server"
+	"google.golang.org/grpc"
+	"io/ioutil"
+	"net"
+)
+
+var (
+	// The service has no authentication, so it only listens on localhost unless told otherwise.
+	listenAddr      = flag.String("listen_addr", "127.0.0.1:61811", "The address to serve the runner service on")
+	root            = flag.String("root", "/var/lib/omogen/runner", "The directory to store compiled programs and evaluations in")
+	dataRoot        = flag.String("data_root", "/var/lib/omogen/data", "The directory that test data paths in evaluation plans are relative to")
+	maxSandboxes    = flag.Int("max_sandboxes", 100, "The maximum number of sandboxes to run concurrently")
+	failOnExhausted = flag.Bool("fail_on_exhausted", false, "Whether requests should fail rather than wait when all sandboxes are in use")
+)
+
+func main() {
+	flag.Parse()
+	defer logger.Init("omogenexec-server", true, false, ioutil.Discard).Close()
+
+	if err := eval.ConfigureSandboxes(*maxSandboxes, !*failOnExhausted); err != nil {
+		logger.Fatalf("Invalid sandbox configuration: %v", err)
+	}
+	eval.InitLanguages()
+	runner, err := server.NewRunnerServer(*root, *dataRoot)
+	if err != nil {
+		logger.Fatalf("Failed creating runner: %v", err)
+	}
+	lis, err := net.Listen("tcp", *listenAddr)
+	if err != nil {
+		logger.Fatalf("Failed listening on %s: %v", *listenAddr, err)
+	}
+	grpcServer := grpc.NewServer()
+	apipb.RegisterRunnerServiceServer(grpcServer, runner)
+	logger.Infof("Serving on %s", *listenAddr)
+	if err := grpcServer.Serve(lis); err != nil {
+		logger.Fatalf("Failed serving: %v", err)
+	}
+}
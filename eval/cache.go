@@ -0,0 +1,242 @@
+package eval
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/google/logger"
+	apipb "github.com/jsannemo/omogenexec/api"
+	"google.golang.org/protobuf/proto"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// cacheVersion is part of every cache key, and must be changed whenever the way test cases are evaluated changes so
+// that stored results would no longer be correct.
+const cacheVersion = "1"
+
+// A ResultStore keeps the results of test cases across evaluations, keyed by the contents of everything the result
+// depends on: the program, the output validator, the input and answer files, the validator flags and the limits.
+// Implementations must be safe for concurrent use.
+type ResultStore interface {
+	// Load returns the result stored for a key, or nil if there is none.
+	Load(key string) (*apipb.Result, error)
+	Store(key string, res *apipb.Result) error
+}
+
+// SetResultStore makes the evaluation look up test cases in the given store before evaluating them, and store the
+// results of the test cases it evaluates in it.
+//
+// Results taken from the store are reported like any other results. Results with a JUDGE_ERROR verdict are never
+// stored, since the problem may be fixed without changing what the key depends on.
+func (e *Evaluator) SetResultStore(store ResultStore) {
+	e.store = store
+}
+
+// loadStored returns the result stored for a key, if there is a result store.
+func (e *Evaluator) loadStored(key string) (*apipb.Result, error) {
+	if e.store == nil {
+		return nil, nil
+	}
+	res, err := e.store.Load(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed loading stored result: %v", err)
+	}
+	return res, nil
+}
+
+// storeResult stores the result of a test case, if there is a result store. Failing to store a result does not fail
+// the evaluation.
+func (e *Evaluator) storeResult(key string, res *apipb.Result) {
+	if e.store == nil || res.Verdict == apipb.Verdict_JUDGE_ERROR {
+		return
+	}
+	if err := e.store.Store(key, res); err != nil {
+		logger.Warningf("failed storing result: %v", err)
+	}
+}
+
+type dirStore struct {
+	dir string
+}
+
+// NewDirStore returns a ResultStore that keeps results as files in the given directory.
+func NewDirStore(dir string) (ResultStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed creating result store: %v", err)
+	}
+	return &dirStore{dir: dir}, nil
+}
+
+func (s *dirStore) path(key string) string {
+	// Results are spread out over subdirectories, to keep directories small.
+	return filepath.Join(s.dir, key[:2], key)
+}
+
+func (s *dirStore) Load(key string) (*apipb.Result, error) {
+	dat, err := ioutil.ReadFile(s.path(key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	res := &apipb.Result{}
+	if err := proto.Unmarshal(dat, res); err != nil {
+		return nil, fmt.Errorf("failed parsing stored result %s: %v", key, err)
+	}
+	return res, nil
+}
+
+func (s *dirStore) Store(key string, res *apipb.Result) error {
+	dat, err := proto.Marshal(res)
+	if err != nil {
+		return err
+	}
+	path := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	// The result is written to a temporary file first, so that concurrent loads never see a partial result.
+	tmp, err := ioutil.TempFile(filepath.Dir(path), key+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(dat); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// planIdentity hashes the parts of the plan that affect the results of all test cases.
+func (e *Evaluator) planIdentity() (string, error) {
+	h := sha256.New()
+	writeFields(h, cacheVersion, e.plan.PlanType, e.validationPasses(), e.plan.ScoringValidator, e.plan.OutputLimitKb,
+		e.plan.TimeLimitMode, e.plan.ValidatorTimeLimitMs, e.plan.ValidatorMemLimitKb, e.capturesOutput(),
+		e.plan.CaptureOutputLimitKb)
+	if rs := e.plan.RelativeScoring; rs != nil {
+		writeFields(h, rs.Direction, rs.Function, rs.Clamp)
+	}
+	writeFields(h, e.plan.ScoreRangePolicy)
+	if e.plan.ScoreRounding != nil {
+		writeFields(h, e.plan.ScoreRounding.Decimals)
+	}
+	for _, program := range []*apipb.CompiledProgram{e.plan.Program, e.plan.Validator} {
+		if program == nil {
+			writeFields(h, "none")
+			continue
+		}
+		digest, err := programDigest(program)
+		if err != nil {
+			return "", err
+		}
+		writeFields(h, digest)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// cacheKey returns the key of the result of a test case in a group.
+//
+// Without a result store, keys only need to tell test cases apart within the evaluation, where the plan and the files
+// do not change, so the paths of the input and answer files are used. Keys of stored results are instead computed
+// from the contents of everything the result depends on, which is much more expensive.
+func (e *Evaluator) cacheKey(tc *apipb.TestCase, tg *apipb.TestGroup, lim caseLimits) (string, error) {
+	h := sha256.New()
+	if e.store == nil {
+		writeFields(h, tc.InputPath, tc.OutputPath)
+	} else {
+		if e.identity == "" {
+			identity, err := e.planIdentity()
+			if err != nil {
+				return "", err
+			}
+			e.identity = identity
+		}
+		writeFields(h, e.identity)
+		for _, path := range []string{tc.InputPath, tc.OutputPath} {
+			digest, err := e.fileDigest(path)
+			if err != nil {
+				return "", err
+			}
+			writeFields(h, digest)
+		}
+	}
+	writeFields(h, len(tg.OutputValidatorFlags))
+	for _, flag := range tg.OutputValidatorFlags {
+		writeFields(h, flag)
+	}
+	writeFields(h, lim.timeLimitMs, lim.memLimitKb)
+	if e.plan.ScoringValidator {
+		// Accepted test cases without a score from the validator get the accept score of their group.
+		writeFields(h, tg.AcceptScore, tg.RejectScore)
+		if r := tg.ScoreRange; r != nil {
+			writeFields(h, r.Min, r.Max)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// fileDigest hashes the contents of a file. Digests are remembered for the duration of the evaluation, since the same
+// files are often used by several test cases.
+func (e *Evaluator) fileDigest(path string) (string, error) {
+	if digest, found := e.digests[path]; found {
+		return digest, nil
+	}
+	h := sha256.New()
+	if err := hashFile(h, path); err != nil {
+		return "", err
+	}
+	digest := hex.EncodeToString(h.Sum(nil))
+	e.digests[path] = digest
+	return digest, nil
+}
+
+// programDigest hashes how a program is run and all the files of the program.
+func programDigest(program *apipb.CompiledProgram) (string, error) {
+	h := sha256.New()
+	writeFields(h, program.Language, len(program.RunCommand))
+	for _, arg := range program.RunCommand {
+		writeFields(h, arg)
+	}
+	err := filepath.Walk(program.ProgramRoot, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(program.ProgramRoot, path)
+		if err != nil {
+			return err
+		}
+		writeFields(h, rel, info.Size())
+		return hashFile(h, path)
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed hashing program: %v", err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func hashFile(h hash.Hash, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(h, f)
+	return err
+}
+
+// writeFields writes values to a hash, separated so that different values never hash the same.
+func writeFields(h hash.Hash, values ...interface{}) {
+	for _, value := range values {
+		fmt.Fprintf(h, "%v\x00", value)
+	}
+}
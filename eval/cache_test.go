@@ -0,0 +1,138 @@
+package eval
+
+import (
+	"context"
+	apipb "github.com/jsannemo/omogenexec/api"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestCacheKeyUsesContents(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{"a.in": "1 2", "a.ans": "3", "b.in": "1 2", "b.ans": "3", "c.in": "2 2"}
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store, err := NewDirStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &Evaluator{plan: &apipb.EvaluationPlan{TimeLimitMs: 1000}, digests: make(map[string]string), store: store}
+	key := func(in, ans string, flags []string, lim caseLimits) string {
+		tc := &apipb.TestCase{InputPath: filepath.Join(dir, in), OutputPath: filepath.Join(dir, ans)}
+		k, err := e.cacheKey(tc, &apipb.TestGroup{OutputValidatorFlags: flags}, lim)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+	lim := e.planLimits()
+	base := key("a.in", "a.ans", nil, lim)
+	if got := key("b.in", "b.ans", nil, lim); got != base {
+		t.Errorf("identical files gave different keys")
+	}
+	if got := key("c.in", "a.ans", nil, lim); got == base {
+		t.Errorf("different inputs gave the same key")
+	}
+	if got := key("a.in", "a.ans", []string{"case_sensitive"}, lim); got == base {
+		t.Errorf("different validator flags gave the same key")
+	}
+	if got := key("a.in", "a.ans", nil, lim.override(2000, 0)); got == base {
+		t.Errorf("different limits gave the same key")
+	}
+}
+
+func TestCacheKeyWithoutStore(t *testing.T) {
+	e := &Evaluator{plan: &apipb.EvaluationPlan{TimeLimitMs: 1000}, digests: make(map[string]string)}
+	// The files do not exist, since keys without a result store do not depend on their contents.
+	key := func(in, ans string) string {
+		k, err := e.cacheKey(&apipb.TestCase{InputPath: in, OutputPath: ans}, &apipb.TestGroup{}, e.planLimits())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+	if key("/a.in", "/a.ans") != key("/a.in", "/a.ans") {
+		t.Errorf("same files gave different keys")
+	}
+	if key("/a.in", "/a.ans") == key("/b.in", "/a.ans") {
+		t.Errorf("different files gave the same key")
+	}
+	if e.identity != "" || len(e.digests) != 0 {
+		t.Errorf("contents were hashed without a result store")
+	}
+}
+
+func TestDirStore(t *testing.T) {
+	store, err := NewDirStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := "0123456789abcdef"
+	if res, err := store.Load(key); err != nil || res != nil {
+		t.Fatalf("Load of missing key = %v, %v; want nil", res, err)
+	}
+	want := &apipb.Result{Verdict: apipb.Verdict_WRONG_ANSWER, TimeUsageMs: 12, Message: "wrong"}
+	if err := store.Store(key, want); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	got, err := store.Load(key)
+	if err != nil || got == nil {
+		t.Fatalf("Load = %v, %v", got, err)
+	}
+	if got.Verdict != want.Verdict || got.TimeUsageMs != want.TimeUsageMs || got.Message != want.Message {
+		t.Errorf("Load = %v, want %v", got, want)
+	}
+}
+
+func TestStoredResultUsesCurrentScores(t *testing.T) {
+	dir := t.TempDir()
+	tc := &apipb.TestCase{Name: "1", InputPath: filepath.Join(dir, "1.in"), OutputPath: filepath.Join(dir, "1.ans")}
+	for _, path := range []string{tc.InputPath, tc.OutputPath} {
+		if err := ioutil.WriteFile(path, []byte("1"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store, err := NewDirStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each run uses a new evaluator, as if the problem was evaluated again after its accept score changed.
+	run := func(acceptScore float64) *apipb.Result {
+		results := make(chan *apipb.Result, 1)
+		e := &Evaluator{
+			root:          dir,
+			plan:          &apipb.EvaluationPlan{},
+			evalCache:     make(map[string]*apipb.Result),
+			resultChan:    results,
+			retainedCases: make(map[string]bool),
+			digests:       make(map[string]string),
+			store:         store,
+		}
+		tg := &apipb.TestGroup{AcceptScore: acceptScore}
+		key, err := e.cacheKey(tc, tg, e.planLimits())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if acceptScore == 1 {
+			e.storeResult(key, &apipb.Result{Type: apipb.ResultType_TEST_CASE, Verdict: apipb.Verdict_ACCEPTED, Score: 1})
+		}
+		q := &caseQueue{ctx: context.Background(), e: e, tg: tg, limits: e.planLimits()}
+		if err := q.add(tc); err != nil {
+			t.Fatal(err)
+		}
+		if err := q.collect(true); err != nil {
+			t.Fatal(err)
+		}
+		return <-results
+	}
+	if res := run(1); res.Score != 1 {
+		t.Errorf("score %v with accept score 1, want 1", res.Score)
+	}
+	if res := run(2); res.Score != 2 {
+		t.Errorf("stored result got score %v after the accept score changed to 2, want 2", res.Score)
+	}
+}
@@ -0,0 +1,56 @@
+package eval
+
+import (
+	"fmt"
+	apipb "github.com/jsannemo/omogenexec/api"
+	"os"
+)
+
+// defaultCaptureLimitKb is the number of kilobytes kept of the standard output and error by default.
+const defaultCaptureLimitKb = 64
+
+// capturesOutput returns whether the output of the program may be needed in any result.
+func (e *Evaluator) capturesOutput() bool {
+	return e.plan.CaptureOutput != apipb.OutputCapture_OUTPUT_CAPTURE_UNSPECIFIED &&
+		e.plan.CaptureOutput != apipb.OutputCapture_CAPTURE_NEVER
+}
+
+// captureOutput reads the beginning of the standard output and error of a program run. An empty path means that the
+// stream is not captured.
+func (e *Evaluator) captureOutput(stdoutPath, stderrPath string) (*apipb.CapturedOutput, error) {
+	if !e.capturesOutput() {
+		return nil, nil
+	}
+	limit := int(e.plan.CaptureOutputLimitKb) * 1024
+	if limit == 0 {
+		limit = defaultCaptureLimitKb * 1024
+	}
+	output := &apipb.CapturedOutput{}
+	var err error
+	if stdoutPath != "" {
+		if output.Stdout, output.StdoutTruncated, err = readPrefix(stdoutPath, limit); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed capturing standard output: %v", err)
+		}
+	}
+	if stderrPath != "" {
+		if output.Stderr, output.StderrTruncated, err = readPrefix(stderrPath, limit); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed capturing standard error: %v", err)
+		}
+	}
+	return output, nil
+}
+
+// keepsOutput returns whether the captured output should be kept in the result of a test case. The test case is a
+// sample if it lies within a sample group.
+func (e *Evaluator) keepsOutput(res *apipb.Result, sample bool) bool {
+	switch e.plan.CaptureOutput {
+	case apipb.OutputCapture_CAPTURE_ALWAYS:
+		return true
+	case apipb.OutputCapture_CAPTURE_ON_FAILURE:
+		return res.Verdict != apipb.Verdict_ACCEPTED
+	case apipb.OutputCapture_CAPTURE_SAMPLES:
+		return sample
+	default:
+		return false
+	}
+}
@@ -1,6 +1,7 @@
 package eval
 
 import (
+	"context"
 	"fmt"
 	apipb "github.com/jsannemo/omogenexec/api"
 	"github.com/jsannemo/omogenexec/util"
@@ -17,9 +18,16 @@ type Compilation struct {
 	CompilerErrors string
 }
 
-type compileFunc func(program *apipb.Program, outputBase util.FileBase) (*Compilation, error)
+type compileFunc func(ctx context.Context, program *apipb.Program, outputBase util.FileBase) (*Compilation, error)
 
+// Compile compiles a program, writing the compiled program to the given output path.
 func Compile(program *apipb.Program, outputPath string) (*Compilation, error) {
+	return CompileContext(context.Background(), program, outputPath)
+}
+
+// CompileContext is like Compile, but aborts the compilation when the context is cancelled or its deadline passes,
+// returning an error wrapping ErrCancelled.
+func CompileContext(ctx context.Context, program *apipb.Program, outputPath string) (*Compilation, error) {
 	langs := GetLanguages()
 	lang, found := langs[program.Language]
 	if !found {
@@ -37,13 +45,17 @@ func Compile(program *apipb.Program, outputPath string) (*Compilation, error) {
 			return nil, fmt.Errorf("failed writing source %s: %v", file.Path, err)
 		}
 	}
-	return lang.compile(program, fb)
+	compilation, err := lang.compile(ctx, program, fb)
+	if err != nil && ctx.Err() != nil {
+		return nil, cancelled(ctx)
+	}
+	return compilation, err
 }
 
 // noCompile represents compilation that only copies some of the source files and uses the given
 // run command to execute the program.
 func noCompile(runCommandTemplate []string, include func(string) bool, language apipb.LanguageGroup) compileFunc {
-	return func(program *apipb.Program, outputBase util.FileBase) (*Compilation, error) {
+	return func(ctx context.Context, program *apipb.Program, outputBase util.FileBase) (*Compilation, error) {
 		var filteredPaths []string
 		for _, file := range program.Sources {
 			if include(file.Path) {
@@ -65,7 +77,7 @@ func noCompile(runCommandTemplate []string, include func(string) bool, language
 }
 
 func simpleCompile(compilerPath string, compilerFlags []string, exec []string, filter func(string) bool, language apipb.LanguageGroup) compileFunc {
-	return func(program *apipb.Program, outputBase util.FileBase) (*Compilation, error) {
+	return func(ctx context.Context, program *apipb.Program, outputBase util.FileBase) (*Compilation, error) {
 		var filteredPaths []string
 		for _, file := range program.Sources {
 			if filter(file.Path) {
@@ -76,8 +88,8 @@ func simpleCompile(compilerPath string, compilerFlags []string, exec []string, f
 			return nil, err
 		}
 		sandboxArgs := sandboxForCompile(outputBase.Path(), language)
-		sandbox := newSandbox(0, sandboxArgs)
-		err := sandbox.Start()
+		sandbox := newSandbox(sandboxArgs)
+		err := sandbox.Start(ctx)
 		if err != nil {
 			return nil, fmt.Errorf("couldn't start compilation sandbox: %v", err)
 		}
@@ -105,7 +117,7 @@ func simpleCompile(compilerPath string, compilerFlags []string, exec []string, f
 }
 
 func javaCompile(javacFlags []string, javaFlags []string, filter func(string) bool, language apipb.LanguageGroup) compileFunc {
-	return func(program *apipb.Program, outputBase util.FileBase) (*Compilation, error) {
+	return func(ctx context.Context, program *apipb.Program, outputBase util.FileBase) (*Compilation, error) {
 		var filteredPaths []string
 		for _, file := range program.Sources {
 			if filter(file.Path) {
@@ -116,11 +128,12 @@ func javaCompile(javacFlags []string, javaFlags []string, filter func(string) bo
 			return nil, err
 		}
 		sandboxArgs := sandboxForCompile(outputBase.Path(), language)
-		sandbox := newSandbox(0, sandboxArgs)
-		err := sandbox.Start()
+		sandbox := newSandbox(sandboxArgs)
+		err := sandbox.Start(ctx)
 		if err != nil {
 			return nil, fmt.Errorf("couldn't start compilation sandbox: %v", err)
 		}
+		defer sandbox.Finish()
 		run, err := sandbox.Run(append([]string{"/usr/bin/javac"}, substituteFiles(javacFlags, filteredPaths)...))
 		if err != nil {
 			return nil, fmt.Errorf("sandbox failed: %v, %v", err, sandbox.sandboxErr.String())
@@ -142,7 +155,7 @@ func javaCompile(javacFlags []string, javaFlags []string, filter func(string) bo
 					return err
 				}
 				if filepath.Ext(path) == ".class" {
-					run, err := sandbox.Run(append([]string{"/usr/bin/javap", path}))
+					run, err := sandbox.Run([]string{"/usr/bin/javap", path})
 					if err != nil {
 						return err
 					}
@@ -171,7 +184,6 @@ func javaCompile(javacFlags []string, javaFlags []string, filter func(string) bo
 			}); err != nil {
 			return nil, err
 		}
-		sandbox.Finish()
 		if len(mains) == 0 {
 			return &Compilation{
 				CompilerErrors: "No main function found",
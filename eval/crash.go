@@ -0,0 +1,149 @@
+package eval
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/google/logger"
+	apipb "github.com/jsannemo/omogenexec/api"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"syscall"
+)
+
+// The amount of standard error that is searched for an uncaught exception.
+const maxExceptionSearchBytes = 64 * 1024
+
+var signalNames = map[syscall.Signal]string{
+	syscall.SIGABRT: "SIGABRT",
+	syscall.SIGALRM: "SIGALRM",
+	syscall.SIGBUS:  "SIGBUS",
+	syscall.SIGFPE:  "SIGFPE",
+	syscall.SIGHUP:  "SIGHUP",
+	syscall.SIGILL:  "SIGILL",
+	syscall.SIGINT:  "SIGINT",
+	syscall.SIGKILL: "SIGKILL",
+	syscall.SIGPIPE: "SIGPIPE",
+	syscall.SIGQUIT: "SIGQUIT",
+	syscall.SIGSEGV: "SIGSEGV",
+	syscall.SIGSYS:  "SIGSYS",
+	syscall.SIGTERM: "SIGTERM",
+	syscall.SIGTRAP: "SIGTRAP",
+	syscall.SIGUSR1: "SIGUSR1",
+	syscall.SIGUSR2: "SIGUSR2",
+	syscall.SIGXCPU: "SIGXCPU",
+	syscall.SIGXFSZ: "SIGXFSZ",
+}
+
+func signalName(signal int) string {
+	if name, found := signalNames[syscall.Signal(signal)]; found {
+		return name
+	}
+	return fmt.Sprintf("signal %d", signal)
+}
+
+var (
+	cppExceptionPattern    = regexp.MustCompile(`terminate called after throwing an instance of '([^']+)'`)
+	csharpExceptionPattern = regexp.MustCompile(`Unhandled [Ee]xception[.:]?\s+([\w.]+)`)
+	javaExceptionPattern   = regexp.MustCompile(`(?m)^Exception in thread "[^"]*" ([\w.$]+)`)
+	pythonTraceback        = []byte("Traceback (most recent call last):")
+	pythonExceptionPattern = regexp.MustCompile(`^([A-Za-z_][\w.]*)(:|$)`)
+)
+
+// runTimeError describes how a program run crashed. The standard error of the run, written to errorPath, is searched
+// for an uncaught exception.
+func runTimeError(exit *execResult, outOfMemory bool, lang apipb.LanguageGroup, errorPath string) *apipb.RunTimeError {
+	rte := &apipb.RunTimeError{}
+	switch exit.ExitType {
+	case exited:
+		rte.Cause = apipb.RunTimeErrorCause_NONZERO_EXIT_CODE
+		rte.ExitCode = int32(exit.ExitCode)
+	case signaled:
+		rte.Cause = apipb.RunTimeErrorCause_SIGNAL
+		rte.Signal = int32(exit.Signal)
+		rte.SignalName = signalName(exit.Signal)
+	}
+	if outOfMemory {
+		rte.Cause = apipb.RunTimeErrorCause_OUT_OF_MEMORY
+	} else if exit.PidLimitReached {
+		rte.Cause = apipb.RunTimeErrorCause_PID_LIMIT
+	}
+	stderr, err := readStderr(errorPath, lang)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warningf("failed reading standard error: %v", err)
+		}
+		return rte
+	}
+	rte.Exception = parseException(lang, stderr)
+	return rte
+}
+
+// readStderr reads the part of the standard error of a program where an uncaught exception is reported. Python prints
+// its traceback when exiting, while the other runtimes print the exception as soon as it happens, so for Python the end
+// of the file is read instead of the start.
+func readStderr(path string, lang apipb.LanguageGroup) ([]byte, error) {
+	if lang != apipb.LanguageGroup_PYTHON_3 {
+		dat, _, err := readPrefix(path, maxExceptionSearchBytes)
+		return dat, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() > maxExceptionSearchBytes {
+		if _, err := f.Seek(-maxExceptionSearchBytes, io.SeekEnd); err != nil {
+			return nil, err
+		}
+	}
+	return ioutil.ReadAll(f)
+}
+
+// parseException finds the type of the uncaught exception reported in the standard error of a program, if any.
+func parseException(lang apipb.LanguageGroup, stderr []byte) string {
+	var pattern *regexp.Regexp
+	switch lang {
+	case apipb.LanguageGroup_CPP:
+		pattern = cppExceptionPattern
+	case apipb.LanguageGroup_CSHARP:
+		pattern = csharpExceptionPattern
+	case apipb.LanguageGroup_JAVA:
+		pattern = javaExceptionPattern
+	case apipb.LanguageGroup_PYTHON_3:
+		return parsePythonException(stderr)
+	default:
+		return ""
+	}
+	if match := pattern.FindSubmatch(stderr); match != nil {
+		return string(match[1])
+	}
+	return ""
+}
+
+// parsePythonException finds the exception of the last traceback, which is the first unindented line after it.
+func parsePythonException(stderr []byte) string {
+	start := bytes.LastIndex(stderr, pythonTraceback)
+	if start == -1 {
+		return ""
+	}
+	lines := bufio.NewScanner(bytes.NewReader(stderr[start+len(pythonTraceback):]))
+	for lines.Scan() {
+		line := lines.Text()
+		if line == "" || strings.HasPrefix(line, " ") {
+			continue
+		}
+		if match := pythonExceptionPattern.FindStringSubmatch(line); match != nil {
+			return match[1]
+		}
+		return ""
+	}
+	return ""
+}
@@ -0,0 +1,46 @@
+package eval
+
+import (
+	apipb "github.com/jsannemo/omogenexec/api"
+	"testing"
+)
+
+func TestParseException(t *testing.T) {
+	tests := []struct {
+		lang   apipb.LanguageGroup
+		stderr string
+		want   string
+	}{
+		{apipb.LanguageGroup_JAVA, "debug\nException in thread \"main\" java.lang.StackOverflowError\n\tat Main.f(Main.java:3)\n", "java.lang.StackOverflowError"},
+		{apipb.LanguageGroup_JAVA, "Exception in thread \"main\" java.lang.ArithmeticException: / by zero\n", "java.lang.ArithmeticException"},
+		{apipb.LanguageGroup_CSHARP, "Unhandled exception. System.IndexOutOfRangeException: Index was outside the bounds of the array.\n", "System.IndexOutOfRangeException"},
+		{apipb.LanguageGroup_CSHARP, "Unhandled Exception:\nSystem.NullReferenceException: Object reference not set\n", "System.NullReferenceException"},
+		{apipb.LanguageGroup_CPP, "terminate called after throwing an instance of 'std::bad_alloc'\n  what():  std::bad_alloc\n", "std::bad_alloc"},
+		{apipb.LanguageGroup_PYTHON_3, "Traceback (most recent call last):\n  File \"a.py\", line 1, in <module>\n    1/0\nZeroDivisionError: division by zero\n", "ZeroDivisionError"},
+		{apipb.LanguageGroup_PYTHON_3, "Traceback (most recent call last):\n  File \"a.py\", line 3, in f\n    f()\n  [Previous line repeated 996 more times]\nRecursionError: maximum recursion depth exceeded\n", "RecursionError"},
+		{apipb.LanguageGroup_PYTHON_3, "Traceback (most recent call last):\n  File \"a.py\", line 1, in <module>\nKeyError: 1\n\nDuring handling of the above exception, another exception occurred:\n\nTraceback (most recent call last):\n  File \"a.py\", line 4, in <module>\nValueError\n", "ValueError"},
+		{apipb.LanguageGroup_PYTHON_3, "some output\n", ""},
+		{apipb.LanguageGroup_GO, "panic: runtime error\n", ""},
+	}
+	for _, test := range tests {
+		if got := parseException(test.lang, []byte(test.stderr)); got != test.want {
+			t.Errorf("parseException(%v, %q) = %q, want %q", test.lang, test.stderr, got, test.want)
+		}
+	}
+}
+
+func TestRunTimeErrorCause(t *testing.T) {
+	missing := "/nonexistent/error"
+	rte := runTimeError(&execResult{ExitType: signaled, Signal: 11}, false, apipb.LanguageGroup_CPP, missing)
+	if rte.Cause != apipb.RunTimeErrorCause_SIGNAL || rte.SignalName != "SIGSEGV" {
+		t.Errorf("segfault gave %v", rte)
+	}
+	rte = runTimeError(&execResult{ExitType: exited, ExitCode: 1, PidLimitReached: true}, false, apipb.LanguageGroup_CPP, missing)
+	if rte.Cause != apipb.RunTimeErrorCause_PID_LIMIT || rte.ExitCode != 1 {
+		t.Errorf("pid limit gave %v", rte)
+	}
+	rte = runTimeError(&execResult{ExitType: memoryExceeded}, true, apipb.LanguageGroup_CPP, missing)
+	if rte.Cause != apipb.RunTimeErrorCause_OUT_OF_MEMORY {
+		t.Errorf("oom kill gave %v", rte)
+	}
+}
@@ -1,6 +1,8 @@
 package eval
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/google/logger"
 	apipb "github.com/jsannemo/omogenexec/api"
@@ -22,109 +24,254 @@ const (
 	exitCodeWa = 43
 )
 
+// ErrCancelled is wrapped by the errors returned when an evaluation or compilation is aborted because its context
+// was cancelled or its deadline passed.
+var ErrCancelled = errors.New("cancelled")
+
+func cancelled(ctx context.Context) error {
+	return fmt.Errorf("%w: %v", ErrCancelled, ctx.Err())
+}
+
+// A judgeError is a failure caused by the problem rather than by the evaluated program, such as a crashing output
+// validator. Instead of failing the evaluation, it gives a JUDGE_ERROR verdict to the affected test case or group.
+type judgeError struct {
+	msg      string
+	feedback *apipb.ValidatorFeedback
+}
+
+func (e *judgeError) Error() string {
+	return e.msg
+}
+
+// setJudgeError gives a result the JUDGE_ERROR verdict if the error is a judge error, and reports whether it was. Like
+// a skipped result, the result then gets the score 0 regardless of the scores of its group.
+func setJudgeError(res *apipb.Result, err error) bool {
+	var jerr *judgeError
+	if !errors.As(err, &jerr) {
+		return false
+	}
+	logger.Errorf("judge error: %v", jerr)
+	res.Verdict = apipb.Verdict_JUDGE_ERROR
+	res.Score = 0
+	res.Message = jerr.msg
+	res.Feedback = jerr.feedback
+	return true
+}
+
 func (e *Evaluator) GetResultForGroup(tcRes *apipb.Result, tg *apipb.TestGroup) *apipb.Result {
 	updatedResult := *tcRes
+	// The result may have been ungraded in the group it was first evaluated in.
+	updatedResult.Ungraded = false
 	if !e.plan.ScoringValidator {
 		if tcRes.Verdict == apipb.Verdict_ACCEPTED {
-			updatedResult.Score = tg.AcceptScore
+			updatedResult.Score = e.roundScore(tg.AcceptScore)
 		} else {
-			updatedResult.Score = tg.RejectScore
+			updatedResult.Score = e.roundScore(tg.RejectScore)
 		}
 	}
 	return &updatedResult
 }
 
 type Evaluator struct {
-	root                     string
-	linker                   *fileLinker
-	valLinker                *fileLinker
-	graderLinker             *fileLinker
-	plan                     *apipb.EvaluationPlan
-	evalCache                map[string]*apipb.Result
-	programSandbox           *sandboxWrapper
-	evalSandbox              *sandboxWrapper
-	graderSandbox            *sandboxWrapper
-	resultChan               chan<- *apipb.Result
-	validatorCommandTemplate []string
-	graderCommandTemplate    []string
+	root                  string
+	graderLinker          *fileLinker
+	plan                  *apipb.EvaluationPlan
+	evalCache             map[string]*apipb.Result
+	workers               []*worker
+	idleWorkers           chan *worker
+	graderSandbox         *sandboxWrapper
+	resultChan            chan<- *apipb.Result
+	graderCommandTemplate []string
+	retention             RetentionPolicy
+	retentionMaxBytes     int64
+	// The total size of the test case directories kept so far, and their names.
+	retainedBytes int64
+	retainedCases map[string]bool
+	store         ResultStore
+	// A hash of everything in the plan that the results of all test cases depend on. It is only computed when there is
+	// a result store, the first time a cache key is needed.
+	identity string
+	// The content hashes of the input and answer files.
+	digests map[string]string
 }
 
 func NewEvaluator(root string, plan *apipb.EvaluationPlan, results chan<- *apipb.Result) (*Evaluator, error) {
-	eval := &Evaluator{
-		root:       root,
-		plan:       plan,
-		evalCache:  make(map[string]*apipb.Result),
-		resultChan: results,
+	if err := checkGroup(plan.RootGroup, ""); err != nil {
+		return nil, fmt.Errorf("invalid plan: %v", err)
 	}
-	if err := eval.initProgram(); err != nil {
-		return nil, fmt.Errorf("failed initializing program: %v", err)
+	if err := checkRelativeScoring(plan); err != nil {
+		return nil, fmt.Errorf("invalid plan: %v", err)
 	}
-	if err := eval.initValidator(); err != nil {
-		return nil, fmt.Errorf("failed initializing validator: %v", err)
+	if err := checkScoreRounding(plan); err != nil {
+		return nil, fmt.Errorf("invalid plan: %v", err)
+	}
+	eval := &Evaluator{
+		root:          root,
+		plan:          plan,
+		evalCache:     make(map[string]*apipb.Result),
+		resultChan:    results,
+		retainedCases: make(map[string]bool),
+		digests:       make(map[string]string),
+	}
+	parallelism := int(plan.Parallelism)
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	eval.idleWorkers = make(chan *worker, parallelism)
+	for i := 0; i < parallelism; i++ {
+		w, err := eval.newWorker(i)
+		if err != nil {
+			return nil, fmt.Errorf("failed initializing worker %d: %v", i, err)
+		}
+		eval.workers = append(eval.workers, w)
 	}
 	if err := eval.initGrader(); err != nil {
 		return nil, fmt.Errorf("failed initializing grader: %v", err)
 	}
+	if sandboxes := eval.sandboxCount(); sandboxes > sandboxIds.size() {
+		return nil, fmt.Errorf("evaluation needs %d sandboxes, but only %d may be used", sandboxes, sandboxIds.size())
+	}
 	return eval, nil
 }
 
-func (e *Evaluator) initProgram() error {
-	fl, err := newFileLinker(filepath.Join(e.root, "env"))
+func (e *Evaluator) sandboxCount() int {
+	count := 0
+	for _, w := range e.workers {
+		count++
+		if w.evalSandbox != nil {
+			count++
+		}
+	}
+	if e.graderSandbox != nil {
+		count++
+	}
+	return count
+}
+
+// startSandboxes starts all sandboxes used by the evaluation. Their IDs are leased together, so that concurrent
+// evaluations waiting for sandbox IDs can not deadlock.
+func (e *Evaluator) startSandboxes(ctx context.Context) error {
+	sandboxIds.groupMu.Lock()
+	defer sandboxIds.groupMu.Unlock()
+	for _, w := range e.workers {
+		if err := w.start(ctx); err != nil {
+			return err
+		}
+	}
+	if e.graderSandbox != nil {
+		if err := e.graderSandbox.Start(ctx); err != nil {
+			return fmt.Errorf("failed starting sandbox: %w", err)
+		}
+	}
+	return nil
+}
+
+func (e *Evaluator) finishSandboxes() {
+	for _, w := range e.workers {
+		w.finish()
+	}
+	if e.graderSandbox != nil {
+		e.graderSandbox.Finish()
+	}
+}
+
+// clearEnvironments removes any files left in the sandbox environments, such as those of an aborted test case.
+func (e *Evaluator) clearEnvironments() {
+	for _, w := range e.workers {
+		if err := w.clear(); err != nil {
+			logger.Warningf("failed clearing worker environment: %v", err)
+		}
+	}
+	if e.graderLinker != nil {
+		if err := e.graderLinker.Clear(); err != nil {
+			logger.Warningf("failed clearing grader environment: %v", err)
+		}
+	}
+}
+
+func (e *Evaluator) initProgram(w *worker) error {
+	fl, err := newFileLinker(w.path(e.root, "env"))
 	if err != nil {
 		return fmt.Errorf("failed creating fileLinker: %v", err)
 	}
-	e.linker = fl
+	w.linker = fl
+	input, output, errorPath, err := w.linker.streamPaths("input")
+	if err != nil {
+		return err
+	}
 	args := sandboxArgs{
 		WorkingDirectory: e.plan.Program.ProgramRoot,
-		InputPath:        e.linker.PathFor("input", false),
-		OutputPath:       e.linker.PathFor("output", true),
-		ErrorPath:        e.linker.PathFor("error", true),
+		InputPath:        input,
+		OutputPath:       output,
+		ErrorPath:        errorPath,
 		ExtraReadPaths: []string{
 			e.plan.Program.ProgramRoot,
 		},
 		ExtraWritePaths: nil,
 		TimeLimitMs:     int(e.plan.TimeLimitMs),
 		MemoryLimitKb:   int(e.plan.MemLimitKb),
+		OutputLimitKb:   int(e.plan.OutputLimitKb),
 	}
 	setLanguageSandbox(&args, e.plan.Program.Language)
-	e.programSandbox = newSandbox(0, args)
+	w.programSandbox = newSandbox(args)
 	return nil
 }
 
-func (e *Evaluator) initValidator() error {
+func (e *Evaluator) initValidator(w *worker) error {
 	if e.plan.Validator == nil {
 		return nil
 	}
-	valfl, err := newFileLinker(filepath.Join(e.root, "valenv"))
+	valfl, err := newFileLinker(w.path(e.root, "valenv"))
 	if err != nil {
 		return fmt.Errorf("failed creating validator fileLinker: %v", err)
 	}
-	e.valLinker = valfl
+	w.valLinker = valfl
+	input, output, errorPath, err := w.valLinker.streamPaths("team_output")
+	if err != nil {
+		return err
+	}
 	args := sandboxArgs{
 		WorkingDirectory: e.plan.Validator.ProgramRoot,
-		InputPath:        e.valLinker.PathFor("team_output", false),
-		OutputPath:       e.valLinker.PathFor("output", true),
-		ErrorPath:        e.valLinker.PathFor("error", true),
+		InputPath:        input,
+		OutputPath:       output,
+		ErrorPath:        errorPath,
 		ExtraReadPaths: []string{
-			e.valLinker.readBase.Path(),
+			w.valLinker.readBase.Path(),
 			e.plan.Validator.ProgramRoot,
 		},
 		ExtraWritePaths: []string{
-			e.valLinker.writeBase.Path(),
+			w.valLinker.writeBase.Path(),
 		},
 		TimeLimitMs:   int(e.plan.ValidatorTimeLimitMs),
 		MemoryLimitKb: int(e.plan.ValidatorMemLimitKb),
 	}
-	if e.plan.PlanType == apipb.EvaluationType_INTERACTIVE {
-		args.OutputPath = e.linker.PathFor("input", false)
-		args.InputPath = e.linker.PathFor("output", true)
+	if e.interactive() {
+		// The validator writes the input of the program and reads its output.
+		if args.OutputPath, err = w.linker.PathFor("input", false); err != nil {
+			return err
+		}
+		if args.InputPath, err = w.linker.PathFor("output", true); err != nil {
+			return err
+		}
+	}
+	w.evalSandbox = newSandbox(args)
+	w.validatorCommandTemplate = append(w.validatorCommandTemplate, e.plan.Validator.RunCommand...)
+	validatorInput, err := w.valLinker.PathFor("input", false)
+	if err != nil {
+		return err
+	}
+	judgeAnswer, err := w.valLinker.PathFor("judge_answer", false)
+	if err != nil {
+		return err
 	}
-	e.evalSandbox = newSandbox(1, args)
-	e.validatorCommandTemplate = append(e.validatorCommandTemplate, e.plan.Validator.RunCommand...)
-	e.validatorCommandTemplate = append(e.validatorCommandTemplate,
-		e.valLinker.PathFor("input", false),
-		e.valLinker.PathFor("judge_answer", false),
-		e.valLinker.PathFor(".", true)+string(filepath.Separator),
+	feedbackDir, err := w.valLinker.PathFor(".", true)
+	if err != nil {
+		return err
+	}
+	w.validatorCommandTemplate = append(w.validatorCommandTemplate,
+		validatorInput,
+		judgeAnswer,
+		feedbackDir+string(filepath.Separator),
 	)
 	return nil
 }
@@ -145,11 +292,15 @@ func (e *Evaluator) initGrader() error {
 		return fmt.Errorf("failed creating grader fileLinker: %v", err)
 	}
 	e.graderLinker = graderfl
+	input, output, errorPath, err := e.graderLinker.streamPaths("input")
+	if err != nil {
+		return err
+	}
 	args := sandboxArgs{
 		WorkingDirectory: e.plan.Grader.ProgramRoot,
-		InputPath:        e.graderLinker.PathFor("input", false),
-		OutputPath:       e.graderLinker.PathFor("output", true),
-		ErrorPath:        e.graderLinker.PathFor("error", true),
+		InputPath:        input,
+		OutputPath:       output,
+		ErrorPath:        errorPath,
 		ExtraReadPaths: []string{
 			e.graderLinker.readBase.Path(),
 			e.plan.Grader.ProgramRoot,
@@ -160,7 +311,7 @@ func (e *Evaluator) initGrader() error {
 		TimeLimitMs:   int((60 * time.Second).Milliseconds()),
 		MemoryLimitKb: 1000 * 1000, // 1000 MB = 1 GB
 	}
-	e.graderSandbox = newSandbox(2, args)
+	e.graderSandbox = newSandbox(args)
 	e.graderCommandTemplate = e.plan.Grader.GetRunCommand()
 	return nil
 }
@@ -170,34 +321,53 @@ func (e *Evaluator) resetPermissions() error {
 	return cmd.Run()
 }
 
+// Evaluate evaluates the plan, sending the results on the result channel as they are produced. The channel is closed
+// when the evaluation is done. See apipb.Result for the order in which results are sent.
 func (e *Evaluator) Evaluate() error {
+	return e.EvaluateContext(context.Background())
+}
+
+// EvaluateContext is like Evaluate, but aborts the evaluation when the context is cancelled or its deadline passes.
+// No more test cases are then started, the running sandboxed commands are killed, and an error wrapping ErrCancelled
+// is returned. Results sent on the result channel before that remain valid.
+func (e *Evaluator) EvaluateContext(ctx context.Context) error {
 	defer close(e.resultChan)
 	logger.Infof("Starting evaluation in %s", e.root)
 	if err := e.resetPermissions(); err != nil {
 		return fmt.Errorf("could not reset permissions: %v", err)
 	}
+	defer e.cleanCaseDirectories()
+	defer e.clearEnvironments()
 	defer e.resetPermissions()
-	if err := e.programSandbox.Start(); err != nil {
-		return fmt.Errorf("failed starting sandbox: %v", err)
-	}
-	defer e.programSandbox.Finish()
-	if e.plan.Validator != nil {
-		if err := e.evalSandbox.Start(); err != nil {
-			return fmt.Errorf("failed starting sandbox: %v", err)
+	defer e.finishSandboxes()
+	if err := e.startSandboxes(ctx); err != nil {
+		if ctx.Err() != nil {
+			return cancelled(ctx)
 		}
-		defer e.evalSandbox.Finish()
+		return err
 	}
-	if e.plan.Grader != nil {
-		if err := e.graderSandbox.Start(); err != nil {
-			return fmt.Errorf("failed starting sandbox: %v", err)
-		}
-		defer e.graderSandbox.Finish()
+	for _, w := range e.workers {
+		e.idleWorkers <- w
+	}
+	_, err := e.evaluateGroup(ctx, e.plan.RootGroup, nil)
+	if err != nil && ctx.Err() != nil {
+		logger.Infof("Cancelled evaluation of %s", e.root)
+		return cancelled(ctx)
 	}
-	_, err := e.evaluateGroup(e.plan.RootGroup)
 	logger.Infof("Completed evaluation of %s", e.root)
 	return err
 }
 
+// report sends a result on the result channel, unless the evaluation is cancelled first.
+func (e *Evaluator) report(ctx context.Context, res *apipb.Result) error {
+	select {
+	case e.resultChan <- res:
+		return nil
+	case <-ctx.Done():
+		return cancelled(ctx)
+	}
+}
+
 type evalable struct {
 	*apipb.TestGroup
 	*apipb.TestCase
@@ -219,17 +389,26 @@ func evalableLess(a *evalable, b *evalable) bool {
 	return aName < bName
 }
 
-// worseness orders, increasingly, verdicts by how they should be returned by the worst error verdict mode.
+// worseness orders, increasingly, verdicts by how they should be returned by the worst error verdict mode. A skipped
+// result is never worse than any other.
 func worseness(v apipb.Verdict) int {
 	switch v {
+	case apipb.Verdict_SKIPPED:
+		return -1
 	case apipb.Verdict_ACCEPTED:
 		return 0
 	case apipb.Verdict_RUN_TIME_ERROR:
 		return 1
-	case apipb.Verdict_TIME_LIMIT_EXCEEDED:
+	case apipb.Verdict_MEMORY_LIMIT_EXCEEDED:
 		return 2
-	case apipb.Verdict_WRONG_ANSWER:
+	case apipb.Verdict_OUTPUT_LIMIT_EXCEEDED:
 		return 3
+	case apipb.Verdict_TIME_LIMIT_EXCEEDED:
+		return 4
+	case apipb.Verdict_WRONG_ANSWER:
+		return 5
+	case apipb.Verdict_JUDGE_ERROR:
+		return 6
 	default:
 		panic(fmt.Sprintf("unknown verdict %v", v))
 	}
@@ -241,10 +420,19 @@ func verdictToAbbreviation(v apipb.Verdict) string {
 		return "AC"
 	case apipb.Verdict_RUN_TIME_ERROR:
 		return "RTE"
+	case apipb.Verdict_MEMORY_LIMIT_EXCEEDED:
+		return "MLE"
+	case apipb.Verdict_OUTPUT_LIMIT_EXCEEDED:
+		return "OLE"
 	case apipb.Verdict_TIME_LIMIT_EXCEEDED:
 		return "TLE"
 	case apipb.Verdict_WRONG_ANSWER:
 		return "WA"
+	case apipb.Verdict_JUDGE_ERROR:
+		return "JE"
+	case apipb.Verdict_SKIPPED:
+		// Skipped results are never graded, and graders can not give this verdict.
+		return "SK"
 	default:
 		panic(fmt.Sprintf("unknown verdict %v", v))
 	}
@@ -256,10 +444,16 @@ func abbreviationToVerdict(v string) (apipb.Verdict, error) {
 		return apipb.Verdict_ACCEPTED, nil
 	case "RTE":
 		return apipb.Verdict_RUN_TIME_ERROR, nil
+	case "MLE":
+		return apipb.Verdict_MEMORY_LIMIT_EXCEEDED, nil
+	case "OLE":
+		return apipb.Verdict_OUTPUT_LIMIT_EXCEEDED, nil
 	case "TLE":
 		return apipb.Verdict_TIME_LIMIT_EXCEEDED, nil
 	case "WA":
 		return apipb.Verdict_WRONG_ANSWER, nil
+	case "JE":
+		return apipb.Verdict_JUDGE_ERROR, nil
 	default:
 		return apipb.Verdict_VERDICT_UNSPECIFIED, fmt.Errorf("unknown abbreviation: %s", v)
 	}
@@ -278,6 +472,12 @@ func (e *Evaluator) mergeRes(results []*apipb.Result, tg *apipb.TestGroup) (*api
 			if res.TimeUsageMs > result.TimeUsageMs {
 				result.TimeUsageMs = res.TimeUsageMs
 			}
+			if res.WallTimeUsageMs > result.WallTimeUsageMs {
+				result.WallTimeUsageMs = res.WallTimeUsageMs
+			}
+			if res.MemoryUsageKb > result.MemoryUsageKb {
+				result.MemoryUsageKb = res.MemoryUsageKb
+			}
 		}
 		if err := e.graderLinker.readBase.WriteFile("input", graderInputs); err != nil {
 			return nil, err
@@ -286,11 +486,8 @@ func (e *Evaluator) mergeRes(results []*apipb.Result, tg *apipb.TestGroup) (*api
 		if err != nil {
 			return nil, fmt.Errorf("failed running grader: %v", err)
 		}
-		if run.TimedOut() {
-			return nil, fmt.Errorf("custom grader timed out")
-		}
-		if run.Crashed() {
-			return nil, fmt.Errorf("custom grader crashed")
+		if run.TimedOut() || run.Crashed() {
+			return nil, &judgeError{msg: fmt.Sprintf("custom grader %s", run.description())}
 		}
 		dat, err := e.graderLinker.writeBase.ReadFile("output")
 		if err != nil {
@@ -298,17 +495,17 @@ func (e *Evaluator) mergeRes(results []*apipb.Result, tg *apipb.TestGroup) (*api
 		}
 		parts := strings.Split(string(dat), " ")
 		if len(parts) != 2 {
-			return nil, fmt.Errorf("invalid grader output: %v", parts)
+			return nil, &judgeError{msg: fmt.Sprintf("invalid grader output: %v", parts)}
 		}
 		parts[1] = strings.TrimSpace(parts[1])
 		score, err := strconv.ParseFloat(parts[1], 64)
 		if err != nil {
-			return nil, fmt.Errorf("invalid grader output: %v", parts)
+			return nil, &judgeError{msg: fmt.Sprintf("invalid grader output: %v", parts)}
 		}
 		result.Score = score
 		verdict, err := abbreviationToVerdict(parts[0])
-		if err != nil {
-			return nil, fmt.Errorf("invalid grader output: %v", parts)
+		if err != nil || verdict == apipb.Verdict_JUDGE_ERROR {
+			return nil, &judgeError{msg: fmt.Sprintf("invalid grader output: %v", parts)}
 		}
 		result.Verdict = verdict
 		return result, nil
@@ -324,13 +521,18 @@ func defaultGrader(results []*apipb.Result, tg *apipb.TestGroup) *apipb.Result {
 		Score:       0,
 		TimeUsageMs: 0,
 	}
-	if tg.ScoringMode == apipb.ScoringMode_MIN {
+	// The score of a MIN or MAX group without results is 0, rather than infinite.
+	if tg.ScoringMode == apipb.ScoringMode_MIN && len(results) > 0 {
 		result.Score = math.Inf(1)
-	} else if tg.ScoringMode == apipb.ScoringMode_MAX {
+	} else if tg.ScoringMode == apipb.ScoringMode_MAX && len(results) > 0 {
 		result.Score = math.Inf(-1)
 	}
 	anyAccepted := false
+	totalWeight := 0.0
 	for _, res := range results {
+		if res.Verdict == apipb.Verdict_SKIPPED {
+			continue
+		}
 		if res.Verdict == apipb.Verdict_ACCEPTED {
 			anyAccepted = true
 		} else if tg.VerdictMode == apipb.VerdictMode_WORST_ERROR && worseness(res.Verdict) > worseness(result.Verdict) {
@@ -341,6 +543,9 @@ func defaultGrader(results []*apipb.Result, tg *apipb.TestGroup) *apipb.Result {
 
 		if tg.ScoringMode == apipb.ScoringMode_SUM || tg.ScoringMode == apipb.ScoringMode_AVG {
 			result.Score += res.Score
+		} else if tg.ScoringMode == apipb.ScoringMode_WEIGHTED_SUM || tg.ScoringMode == apipb.ScoringMode_WEIGHTED_AVG {
+			result.Score += res.Score * res.Weight
+			totalWeight += res.Weight
 		} else if tg.ScoringMode == apipb.ScoringMode_MIN {
 			result.Score = math.Min(result.Score, res.Score)
 		} else if tg.ScoringMode == apipb.ScoringMode_MAX {
@@ -349,6 +554,15 @@ func defaultGrader(results []*apipb.Result, tg *apipb.TestGroup) *apipb.Result {
 		if res.TimeUsageMs > result.TimeUsageMs {
 			result.TimeUsageMs = res.TimeUsageMs
 		}
+		if res.WallTimeUsageMs > result.WallTimeUsageMs {
+			result.WallTimeUsageMs = res.WallTimeUsageMs
+		}
+		if res.MemoryUsageKb > result.MemoryUsageKb {
+			result.MemoryUsageKb = res.MemoryUsageKb
+		}
+	}
+	if tg.ScoringMode == apipb.ScoringMode_WEIGHTED_AVG && totalWeight > 0 {
+		result.Score /= totalWeight
 	}
 
 	if tg.VerdictMode == apipb.VerdictMode_ALWAYS_ACCEPT || (anyAccepted && tg.AcceptIfAnyAccepted) {
@@ -357,7 +571,100 @@ func defaultGrader(results []*apipb.Result, tg *apipb.TestGroup) *apipb.Result {
 	return result
 }
 
-func (e *Evaluator) evaluateGroup(tg *apipb.TestGroup) (*apipb.Result, error) {
+// caseLimits are the resource limits of the program when it is run on a test case.
+type caseLimits struct {
+	timeLimitMs int32
+	memLimitKb  int32
+}
+
+func (e *Evaluator) planLimits() caseLimits {
+	return caseLimits{timeLimitMs: e.plan.TimeLimitMs, memLimitKb: e.plan.MemLimitKb}
+}
+
+// override returns the limits with those that are set replaced.
+func (l caseLimits) override(timeLimitMs, memLimitKb int32) caseLimits {
+	if timeLimitMs != 0 {
+		l.timeLimitMs = timeLimitMs
+	}
+	if memLimitKb != 0 {
+		l.memLimitKb = memLimitKb
+	}
+	return l
+}
+
+// runOptions returns the options for running the program with the given limits.
+func (e *Evaluator) runOptions(lim caseLimits) runOptions {
+	opts := runOptions{TimeLimitMs: int(lim.timeLimitMs), MemoryLimitKb: int(lim.memLimitKb)}
+	if e.plan.TimeLimitMode == apipb.TimeLimitMode_WALL_TIME_LIMIT && lim.timeLimitMs > 0 {
+		// Like for the CPU time limit, the program may run a while past the limit to show judges close calls.
+		opts.WallTimeLimitMs = int(lim.timeLimitMs) + 1000
+	}
+	return opts
+}
+
+// resultPath returns the path of a test case or group with the given name, inside a group with the given path.
+func resultPath(groupPath, name string) string {
+	if groupPath == "" {
+		return name
+	}
+	return groupPath + "/" + name
+}
+
+// checkGroup verifies that a group and its subgroups are configured consistently.
+func checkGroup(tg *apipb.TestGroup, path string) error {
+	if tg == nil {
+		return fmt.Errorf("missing root group")
+	}
+	if tg.GetWeight() < 0 {
+		return fmt.Errorf("%s has negative weight %v", describeGroup(path), tg.GetWeight())
+	}
+	for _, tc := range tg.Cases {
+		if tc.GetWeight() < 0 {
+			return fmt.Errorf("test case %q has negative weight %v", resultPath(path, tc.Name), tc.GetWeight())
+		}
+	}
+	hasSample := false
+	for _, group := range tg.Groups {
+		if group.IsSample {
+			hasSample = true
+		}
+		if err := checkGroup(group, resultPath(path, group.Name)); err != nil {
+			return err
+		}
+	}
+	if tg.IgnoreSample && !hasSample {
+		return fmt.Errorf("%s ignores samples but has no sample group", describeGroup(path))
+	}
+	if r := tg.ScoreRange; r != nil {
+		if !(r.Min <= r.Max) {
+			return fmt.Errorf("%s has empty score range [%v, %v]", describeGroup(path), r.Min, r.Max)
+		}
+		for _, score := range []float64{tg.AcceptScore, tg.RejectScore} {
+			if score < r.Min || score > r.Max {
+				return fmt.Errorf("%s has score %v outside of its range [%v, %v]", describeGroup(path), score, r.Min, r.Max)
+			}
+		}
+	}
+	return nil
+}
+
+func describeGroup(path string) string {
+	if path == "" {
+		return "the root group"
+	}
+	return fmt.Sprintf("group %q", path)
+}
+
+// weight returns the weight of a test case or group, which defaults to 1 when unset.
+func weight(w *float64) float64 {
+	if w == nil {
+		return 1
+	}
+	return *w
+}
+
+// sortedEvalables returns the test cases and subgroups of a group in the order they are evaluated.
+func sortedEvalables(tg *apipb.TestGroup) []evalable {
 	var evalables []evalable = nil
 	for _, group := range tg.Groups {
 		evalables = append(evalables, evalable{TestGroup: group})
@@ -368,54 +675,473 @@ func (e *Evaluator) evaluateGroup(tg *apipb.TestGroup) (*apipb.Result, error) {
 	sort.Slice(evalables, func(i, j int) bool {
 		return evalableLess(&evalables[i], &evalables[j])
 	})
+	return evalables
+}
+
+// evaluateGroup evaluates a group inside the group whose test cases are queued in parent, which is nil for the root
+// group. The group inherits the limits of its parent, and is a sample group if its parent is.
+func (e *Evaluator) evaluateGroup(ctx context.Context, tg *apipb.TestGroup, parent *caseQueue) (*apipb.Result, error) {
+	path, lim, sample := "", e.planLimits(), false
+	if parent != nil {
+		path, lim, sample = resultPath(parent.path, tg.Name), parent.limits, parent.sample
+	}
+	lim = lim.override(tg.TimeLimitMs, tg.MemLimitKb)
+	sample = sample || tg.IsSample
+	evalables := sortedEvalables(tg)
 
-	var res []*apipb.Result
+	q := &caseQueue{ctx: ctx, e: e, tg: tg, path: path, limits: lim, sample: sample}
+	// The results of the sample subgroups, which are not graded if the group ignores samples.
+	sampleResults := make(map[*apipb.Result]bool)
 	for _, eval := range evalables {
-		var subres *apipb.Result
+		if q.broken {
+			break
+		}
+		if ctx.Err() != nil {
+			q.abandon()
+			return nil, cancelled(ctx)
+		}
 		if group := eval.TestGroup; group != nil {
-			var err error
-			subres, err = e.evaluateGroup(group)
+			// Results of earlier test cases must be reported before any results of the group.
+			if err := q.collect(true); err != nil {
+				return nil, err
+			}
+			if q.broken {
+				break
+			}
+			subres, err := e.evaluateGroup(ctx, group, q)
 			if err != nil {
 				return nil, err
 			}
-		} else {
-			var err error
-			tc := eval.TestCase
-			cacheKey := tc.InputPath + " " + tc.OutputPath + strings.Join(tg.OutputValidatorFlags, " ")
-			if cached, found := e.evalCache[cacheKey]; found {
-				subres = e.GetResultForGroup(cached, tg)
-			} else {
-				subres, err = e.evaluateCase(tc, tg)
-				if err != nil {
-					return nil, fmt.Errorf("failed on case %s: %v", eval.TestCase.Name, err)
-				}
-				e.evalCache[cacheKey] = subres
+			if group.IsSample {
+				sampleResults[subres] = true
 			}
+			q.record(subres)
+		} else if err := q.add(eval.TestCase); err != nil {
+			return nil, err
 		}
-		res = append(res, subres)
-		if subres.Verdict != apipb.Verdict_ACCEPTED && tg.BreakOnFail {
-			break
+	}
+	if err := q.collect(true); err != nil {
+		return nil, err
+	}
+	// Every test case and subgroup before the first unevaluated one has a recorded result.
+	for _, eval := range evalables[len(q.recorded):] {
+		if err := e.reportSkipped(ctx, eval, path); err != nil {
+			return nil, err
 		}
 	}
-	// By happy coincidence, sample < secret in sort order, so sample is always the first result for the root group.
+	res := q.results
 	if tg.IgnoreSample {
-		res = res[1:]
+		res = nil
+		for _, r := range q.results {
+			if !sampleResults[r] {
+				res = append(res, r)
+			}
+		}
 	}
-	groupRes, err := e.mergeRes(res, tg)
-	if err != nil {
+	var groupRes *apipb.Result
+	// Ungraded results are included, so that a judge error is never hidden.
+	if failed := firstJudgeError(q.recorded); failed != nil {
+		groupRes = judgeErrorGroupResult(failed)
+	} else {
+		merged, err := e.mergeRes(res, tg)
+		if err == nil {
+			merged.Score, err = e.checkScore(merged.Score, tg)
+		}
+		if err != nil {
+			merged = &apipb.Result{Type: apipb.ResultType_TEST_GROUP}
+			if !setJudgeError(merged, err) {
+				return nil, err
+			}
+			merged.Message = fmt.Sprintf("grading of %s failed: %s", describeGroup(path), merged.Message)
+		}
+		groupRes = merged
+	}
+	groupRes.Name = tg.Name
+	groupRes.Path = path
+	groupRes.Ungraded = parent != nil && parent.pastBreak
+	groupRes.Weight = weight(tg.Weight)
+	if err := e.report(ctx, groupRes); err != nil {
 		return nil, err
 	}
-	e.resultChan <- groupRes
 	return groupRes, nil
 }
 
-func (e *Evaluator) evaluateInteractive(tc *apipb.TestCase, tg *apipb.TestGroup) (*apipb.Result, error) {
-	programInput := e.linker.PathFor("input", false)
-	programOutput := e.linker.PathFor("output", true)
-	if err := e.valLinker.LinkFile(tc.InputPath, "input", false); err != nil {
+// reportSkipped reports a SKIPPED result for a test case or group that was not evaluated, inside a group with the
+// given path. The contents of a skipped group are reported as skipped too.
+func (e *Evaluator) reportSkipped(ctx context.Context, eval evalable, groupPath string) error {
+	res := &apipb.Result{Verdict: apipb.Verdict_SKIPPED}
+	if group := eval.TestGroup; group != nil {
+		res.Type = apipb.ResultType_TEST_GROUP
+		res.Name = group.Name
+		for _, sub := range sortedEvalables(group) {
+			if err := e.reportSkipped(ctx, sub, resultPath(groupPath, group.Name)); err != nil {
+				return err
+			}
+		}
+	} else {
+		res.Type = apipb.ResultType_TEST_CASE
+		res.Name = eval.TestCase.Name
+	}
+	res.Path = resultPath(groupPath, res.Name)
+	return e.report(ctx, res)
+}
+
+func firstJudgeError(results []*apipb.Result) *apipb.Result {
+	for _, res := range results {
+		if res.Verdict == apipb.Verdict_JUDGE_ERROR {
+			return res
+		}
+	}
+	return nil
+}
+
+// judgeErrorGroupResult returns the result of a group containing a test case or group with a judge error. Its message
+// describes where the judge error happened.
+func judgeErrorGroupResult(failed *apipb.Result) *apipb.Result {
+	msg := failed.Message
+	if failed.Type == apipb.ResultType_TEST_CASE {
+		msg = fmt.Sprintf("test case %q: %s", failed.Path, failed.Message)
+	}
+	return &apipb.Result{
+		Type:    apipb.ResultType_TEST_GROUP,
+		Verdict: apipb.Verdict_JUDGE_ERROR,
+		Message: msg,
+	}
+}
+
+// A caseJob is the evaluation of a test case, which may run concurrently with the evaluation of other test cases.
+type caseJob struct {
+	tc *apipb.TestCase
+	// The directory the output of the program on the test case is kept in.
+	dir      string
+	cacheKey string
+	// done is closed once res and err have been set.
+	done chan struct{}
+	res  *apipb.Result
+	err  error
+	// Whether this is the first job with its cache key in the evaluation. The test case was then either evaluated by the
+	// job or its result was taken from the result store, and later jobs with the same key reuse its result.
+	fresh bool
+	// An earlier job with the same cache key, that this job should take its result from.
+	source *caseJob
+}
+
+// A caseQueue keeps track of the test cases of a group that are being evaluated, so that their results are recorded
+// and reported in the same order as if they were evaluated sequentially.
+type caseQueue struct {
+	ctx    context.Context
+	e      *Evaluator
+	tg     *apipb.TestGroup
+	path   string
+	limits caseLimits
+	// Whether the group is a sample group or lies within one.
+	sample  bool
+	pending []*caseJob
+	// The results that count towards the result of the group.
+	results []*apipb.Result
+	// The results of all test cases and subgroups that have been recorded, whether they count or not.
+	recorded []*apipb.Result
+	// Whether a failed result caused the group to stop evaluating further test cases.
+	broken bool
+	// Whether a failed result would have stopped the group, had the plan not asked to evaluate past it. Later results
+	// are then ungraded.
+	pastBreak bool
+}
+
+func (q *caseQueue) record(res *apipb.Result) {
+	q.recorded = append(q.recorded, res)
+	if res.Verdict == apipb.Verdict_JUDGE_ERROR && q.e.plan.JudgeErrorPolicy != apipb.JudgeErrorPolicy_CONTINUE {
+		q.broken = true
+	}
+	if q.pastBreak {
+		return
+	}
+	q.results = append(q.results, res)
+	if res.Verdict != apipb.Verdict_ACCEPTED && q.tg.BreakOnFail {
+		if q.e.plan.EvaluateAfterBreak {
+			q.pastBreak = true
+		} else {
+			q.broken = true
+		}
+	}
+	if q.e.groupDetermined(q.results, q.tg) {
+		q.broken = true
+	}
+}
+
+// add schedules the evaluation of a test case, waiting until a worker is available if necessary.
+func (q *caseQueue) add(tc *apipb.TestCase) error {
+	lim := q.limits.override(tc.TimeLimitMs, tc.MemLimitKb)
+	cacheKey, err := q.e.cacheKey(tc, q.tg, lim)
+	if err != nil {
+		return fmt.Errorf("failed computing cache key of case %s: %v", tc.Name, err)
+	}
+	job := &caseJob{
+		tc:       tc,
+		dir:      q.e.caseDir(resultPath(q.path, tc.Name)),
+		cacheKey: cacheKey,
+	}
+	// The result store is only consulted when the result is not already known in this evaluation.
+	if cached, found := q.e.evalCache[job.cacheKey]; found {
+		job.res = cached
+		job.done = make(chan struct{})
+		close(job.done)
+	} else if source := q.find(job.cacheKey); source != nil {
+		job.source = source
+		job.done = source.done
+	} else if stored, err := q.e.loadStored(job.cacheKey); err != nil {
+		return err
+	} else if stored != nil {
+		// Without a scoring validator, the key does not depend on the scores of the group, which may have changed since
+		// the result was stored.
+		job.res = q.e.GetResultForGroup(stored, q.tg)
+		job.fresh = true
+		job.done = make(chan struct{})
+		close(job.done)
+	} else {
+		w, err := q.acquireWorker()
+		if err != nil {
+			return err
+		}
+		if w == nil {
+			return nil
+		}
+		job.fresh = true
+		job.done = make(chan struct{})
+		go func() {
+			job.res, job.err = q.e.evaluateCaseRetrying(q.ctx, w, tc, job.dir, q.tg, lim)
+			if job.err == nil {
+				q.e.storeResult(job.cacheKey, job.res)
+			}
+			q.e.idleWorkers <- w
+			close(job.done)
+		}()
+	}
+	q.pending = append(q.pending, job)
+	return nil
+}
+
+func (q *caseQueue) find(cacheKey string) *caseJob {
+	for _, job := range q.pending {
+		if job.fresh && job.cacheKey == cacheKey {
+			return job
+		}
+	}
+	return nil
+}
+
+// acquireWorker waits for an idle worker, recording the results of test cases that finish in the meantime. If the
+// group stops evaluating test cases while waiting, no worker is returned.
+func (q *caseQueue) acquireWorker() (*worker, error) {
+	for {
+		if err := q.collect(false); err != nil {
+			return nil, err
+		}
+		if q.broken {
+			return nil, nil
+		}
+		var headDone chan struct{}
+		if len(q.pending) > 0 {
+			headDone = q.pending[0].done
+		}
+		select {
+		case w := <-q.e.idleWorkers:
+			return w, nil
+		case <-headDone:
+		case <-q.ctx.Done():
+			q.abandon()
+			return nil, cancelled(q.ctx)
+		}
+	}
+}
+
+// collect records the results of pending test cases in order. Unless wait is set, it stops at the first test case
+// that is still being evaluated.
+func (q *caseQueue) collect(wait bool) error {
+	for len(q.pending) > 0 {
+		job := q.pending[0]
+		if wait {
+			<-job.done
+		} else {
+			select {
+			case <-job.done:
+			default:
+				return nil
+			}
+		}
+		q.pending = q.pending[1:]
+		if q.broken {
+			// A sequential evaluation would never have evaluated this test case, so its result is discarded.
+			continue
+		}
+		if job.err != nil {
+			q.abandon()
+			return fmt.Errorf("failed on case %s: %v", job.tc.Name, job.err)
+		}
+		if job.fresh {
+			job.res.Name = job.tc.Name
+			job.res.Path = resultPath(q.path, job.tc.Name)
+			if !q.e.keepsOutput(job.res, q.sample) {
+				job.res.Output = nil
+			}
+			job.res.Ungraded = q.pastBreak
+			job.res.Weight = weight(job.tc.Weight)
+			q.e.evalCache[job.cacheKey] = job.res
+			if err := q.e.report(q.ctx, job.res); err != nil {
+				q.abandon()
+				return err
+			}
+			q.record(job.res)
+			q.e.retainCase(job.dir, job.res)
+		} else {
+			res := job.res
+			if job.source != nil {
+				res = job.source.res
+			}
+			// The result may be that of another test case with the same contents but a different name and weight.
+			res = q.e.GetResultForGroup(res, q.tg)
+			res.Name = job.tc.Name
+			res.Path = resultPath(q.path, job.tc.Name)
+			if !q.e.keepsOutput(res, q.sample) {
+				res.Output = nil
+			}
+			res.Ungraded = q.pastBreak
+			res.Weight = weight(job.tc.Weight)
+			if err := q.e.report(q.ctx, res); err != nil {
+				q.abandon()
+				return err
+			}
+			q.record(res)
+		}
+	}
+	return nil
+}
+
+// abandon waits for all pending test cases to finish, without recording their results.
+func (q *caseQueue) abandon() {
+	for _, job := range q.pending {
+		<-job.done
+	}
+	q.pending = nil
+}
+
+// interactive returns whether the program communicates with the validator rather than writing its output to a file.
+func (e *Evaluator) interactive() bool {
+	return e.plan.PlanType == apipb.EvaluationType_INTERACTIVE || e.plan.PlanType == apipb.EvaluationType_MULTI_PASS
+}
+
+// validationPasses returns the maximum number of times the program may be run on a test case.
+func (e *Evaluator) validationPasses() int {
+	if e.plan.PlanType != apipb.EvaluationType_MULTI_PASS {
+		return 1
+	}
+	if e.plan.ValidationPasses < 1 {
+		return 2
+	}
+	return int(e.plan.ValidationPasses)
+}
+
+// An interactiveRun is a single run of a program communicating with the validator.
+type interactiveRun struct {
+	program   *execResult
+	validator *ValidatorOutput
+	// Whether the validator exited before the program did.
+	validatorFirst bool
+	// How the program crashed, if it did.
+	crash *apipb.RunTimeError
+	// The captured standard error of the program.
+	output *apipb.CapturedOutput
+}
+
+func (e *Evaluator) evaluateInteractive(w *worker, tc *apipb.TestCase, tcPath string, tg *apipb.TestGroup, lim caseLimits) (*apipb.Result, error) {
+	passes := e.validationPasses()
+	tcBase := util.NewFileBase(tcPath)
+	tcBase.OwnerGid = util.OmogenexecGroupId()
+	res := &apipb.Result{
+		Type: apipb.ResultType_TEST_CASE,
+	}
+	inputPath := tc.InputPath
+	for pass := 1; ; pass++ {
+		run, err := e.runInteractive(w, inputPath, tc.OutputPath, tg, lim)
+		if err != nil {
+			if !setJudgeError(res, err) {
+				return nil, err
+			}
+			if err := w.clear(); err != nil {
+				return nil, fmt.Errorf("failed clearing environments: %v", err)
+			}
+			return res, nil
+		}
+		// Limits apply to each pass separately, so the usage of the test case is the largest usage of any pass.
+		if run.program.TimeUsageMs > res.TimeUsageMs {
+			res.TimeUsageMs = run.program.TimeUsageMs
+		}
+		if run.program.WallTimeUsageMs > res.WallTimeUsageMs {
+			res.WallTimeUsageMs = run.program.WallTimeUsageMs
+		}
+		if run.program.MemoryUsageKb > res.MemoryUsageKb {
+			res.MemoryUsageKb = run.program.MemoryUsageKb
+		}
+		// The verdict of the program takes precedence over any request for another pass.
+		e.setInteractiveVerdict(res, run, tg, lim)
+		nextPass := false
+		if passes > 1 && res.Verdict == apipb.Verdict_ACCEPTED {
+			if nextPass, err = w.valLinker.writeBase.Exists(nextPassFile); err != nil {
+				return nil, fmt.Errorf("failed checking for next pass input: %v", err)
+			}
+		}
+		if nextPass && pass == passes {
+			setJudgeError(res, &judgeError{
+				msg:      fmt.Sprintf("output validator requested more than %d passes", passes),
+				feedback: run.validator.Feedback,
+			})
+		}
+		if !nextPass || pass == passes {
+			if err := w.clear(); err != nil {
+				return nil, fmt.Errorf("failed clearing environments: %v", err)
+			}
+			return res, nil
+		}
+
+		// The input is moved out of the feedback directory, which the validator keeps between passes, so that it does
+		// not look like a request for yet another pass.
+		if err := tcBase.Mkdir("."); err != nil {
+			return nil, fmt.Errorf("failed creating test case directory: %v", err)
+		}
+		passInput := fmt.Sprintf("pass-%d.in", pass+1)
+		nextPassPath, err := w.valLinker.PathFor(nextPassFile, true)
+		if err != nil {
+			return nil, err
+		}
+		if err := tcBase.Copy(nextPassPath, passInput); err != nil {
+			return nil, fmt.Errorf("failed copying next pass input: %v", err)
+		}
+		if err := os.Remove(nextPassPath); err != nil {
+			return nil, fmt.Errorf("failed removing next pass input: %v", err)
+		}
+		if inputPath, err = tcBase.FullPath(passInput); err != nil {
+			return nil, err
+		}
+		if err := w.linker.Clear(); err != nil {
+			return nil, fmt.Errorf("failed clearing program environment: %v", err)
+		}
+		if err := w.valLinker.ClearReadable(); err != nil {
+			return nil, fmt.Errorf("failed clearing validator environment: %v", err)
+		}
+	}
+}
+
+// runInteractive runs the program on an input, letting it communicate with the validator. The environments of the
+// worker are left as they were after the run, so that the caller can inspect the validator feedback.
+func (e *Evaluator) runInteractive(w *worker, inputPath, answerPath string, tg *apipb.TestGroup, lim caseLimits) (*interactiveRun, error) {
+	programInput, programOutput, programError, err := w.linker.streamPaths("input")
+	if err != nil {
+		return nil, err
+	}
+	if err := w.valLinker.LinkFile(inputPath, "input", false); err != nil {
 		return nil, err
 	}
-	if err := e.valLinker.LinkFile(tc.OutputPath, "judge_answer", false); err != nil {
+	if err := w.valLinker.LinkFile(answerPath, "judge_answer", false); err != nil {
 		return nil, err
 	}
 
@@ -426,19 +1152,19 @@ func (e *Evaluator) evaluateInteractive(tc *apipb.TestCase, tg *apipb.TestGroup)
 		return nil, fmt.Errorf("failed making interactive pipe: %v", err)
 	}
 
-	e.linker.readBase.GroupWritable = true
-	if err := e.linker.readBase.FixMode("input"); err != nil {
+	w.linker.readBase.GroupWritable = true
+	if err := w.linker.readBase.FixMode("input"); err != nil {
 		return nil, fmt.Errorf("failed fixing mode for interactive input: %v", err)
 	}
-	if err := e.linker.readBase.FixOwners("input"); err != nil {
+	if err := w.linker.readBase.FixOwners("input"); err != nil {
 		return nil, fmt.Errorf("failed fixing owners for interactive input: %v", err)
 	}
-	e.linker.readBase.GroupWritable = false
+	w.linker.readBase.GroupWritable = false
 
-	if err := e.linker.writeBase.FixMode("output"); err != nil {
+	if err := w.linker.writeBase.FixMode("output"); err != nil {
 		return nil, fmt.Errorf("failed fixing mode for interactive output: %v", err)
 	}
-	if err := e.linker.writeBase.FixOwners("output"); err != nil {
+	if err := w.linker.writeBase.FixOwners("output"); err != nil {
 		return nil, fmt.Errorf("failed fixing owners for interactive output: %v", err)
 
 	}
@@ -453,16 +1179,16 @@ func (e *Evaluator) evaluateInteractive(tc *apipb.TestCase, tg *apipb.TestGroup)
 	wg := sync.WaitGroup{}
 	wg.Add(2)
 	go func() {
-		programRun, programErr = e.programSandbox.Run(e.plan.Program.RunCommand)
+		programRun, programErr = w.programSandbox.RunWith(e.plan.Program.RunCommand, e.runOptions(lim))
 		outWrite.Close()
 		wg.Done()
 	}()
 	go func() {
-		validatorRun, validatorErr = e.evalSandbox.Run(e.validatorCommand(tg.OutputValidatorFlags))
+		validatorRun, validatorErr = w.evalSandbox.Run(w.validatorCommand(tg.OutputValidatorFlags))
 		inWrite.Close()
 		if programRun == nil {
 			validatorFirst = true
-			if !validatorRun.CrashedWith(exitCodeAc) {
+			if validatorErr != nil || !validatorRun.CrashedWith(exitCodeAc) {
 				outRead.Close()
 			}
 		}
@@ -472,145 +1198,228 @@ func (e *Evaluator) evaluateInteractive(tc *apipb.TestCase, tg *apipb.TestGroup)
 	inRead.Close()
 	outRead.Close()
 	if programErr != nil {
-		return nil, fmt.Errorf("program run failed: %v", programErr)
+		return nil, fmt.Errorf("program run failed: %w", programErr)
 	}
 	if validatorErr != nil {
-		return nil, fmt.Errorf("validator run failed: %v", validatorErr)
+		return nil, fmt.Errorf("validator run failed: %w", validatorErr)
 	}
 
-	val, err := e.validatorOutputFromExit(validatorRun)
+	val, err := e.validatorOutputFromExit(w, validatorRun)
 	if err != nil {
 		return nil, err
 	}
-
-	if err := e.linker.Clear(); err != nil {
-		return nil, fmt.Errorf("failed clearing program environment: %v", err)
+	run := &interactiveRun{
+		program:        programRun,
+		validator:      val,
+		validatorFirst: validatorFirst,
 	}
-	if err := e.linker.Clear(); err != nil {
-		return nil, fmt.Errorf("failed clearing program environment: %v", err)
+	// The standard error of the program is cleared with its environment, so it is inspected right away.
+	if outOfMemory := e.exceededMemory(programRun, lim); outOfMemory || programRun.Crashed() {
+		run.crash = runTimeError(programRun, outOfMemory, e.plan.Program.Language, programError)
 	}
-	if err := e.valLinker.Clear(); err != nil {
-		return nil, fmt.Errorf("failed clearing validator environment: %v", err)
+	if run.output, err = e.captureOutput("", programError); err != nil {
+		return nil, err
 	}
+	return run, nil
+}
 
-	res := &apipb.Result{
-		Score:       tg.RejectScore,
-		TimeUsageMs: programRun.TimeUsageMs,
-	}
-	if programRun.TimedOut() {
+// setInteractiveVerdict sets the verdict, score and message of a result from an interactive run.
+func (e *Evaluator) setInteractiveVerdict(res *apipb.Result, run *interactiveRun, tg *apipb.TestGroup, lim caseLimits) {
+	programRun, val := run.program, run.validator
+	res.Score = tg.RejectScore
+	res.Message = ""
+	res.Feedback = val.Feedback
+	res.KillReason = programRun.killReason()
+	res.RunTimeError = nil
+	res.Output = run.output
+	if e.exceededTime(programRun, lim) {
 		res.Verdict = apipb.Verdict_TIME_LIMIT_EXCEEDED
-	} else if programRun.Crashed() && programRun.Signal != int(syscall.SIGPIPE) && (!validatorFirst || val.Accepted) {
+	} else if e.exceededMemory(programRun, lim) {
+		res.Verdict = apipb.Verdict_MEMORY_LIMIT_EXCEEDED
+		res.RunTimeError = run.crash
+	} else if programRun.Crashed() && programRun.Signal != int(syscall.SIGPIPE) && (!run.validatorFirst || val.Accepted) {
 		res.Verdict = apipb.Verdict_RUN_TIME_ERROR
+		res.RunTimeError = run.crash
 	} else {
 		res.Message = val.JudgeMessage
+		e.setValidatorVerdict(res, val, tg)
+	}
+}
 
-		if e.plan.ScoringValidator && val.HasScore {
-			res.Score = val.Score
-		} else if val.Accepted {
-			res.Score = tg.AcceptScore
-		} else {
-			res.Score = tg.RejectScore
-		}
+// setValidatorVerdict sets the verdict and score of a result from the output of the validator.
+func (e *Evaluator) setValidatorVerdict(res *apipb.Result, val *ValidatorOutput, tg *apipb.TestGroup) {
+	if e.plan.RelativeScoring != nil && val.Accepted {
+		res.Score = val.Score * tg.AcceptScore
+	} else if e.plan.ScoringValidator && val.HasScore {
+		res.Score = val.Score
+	} else if val.Accepted {
+		res.Score = tg.AcceptScore
+	} else {
+		res.Score = tg.RejectScore
+	}
 
-		if val.Accepted {
-			res.Verdict = apipb.Verdict_ACCEPTED
-		} else {
-			res.Verdict = apipb.Verdict_WRONG_ANSWER
+	if val.Accepted {
+		res.Verdict = apipb.Verdict_ACCEPTED
+	} else {
+		res.Verdict = apipb.Verdict_WRONG_ANSWER
+	}
+}
+
+// maxSandboxRetries is the number of times the evaluation of a test case is retried after a sandbox failed.
+const maxSandboxRetries = 2
+
+// sandboxFailed checks whether an error was caused by a failing sandbox, rather than by the test case.
+func sandboxFailed(err error) bool {
+	return errors.Is(err, ErrSandboxDied) || errors.Is(err, ErrSandboxProtocol)
+}
+
+// evaluateCaseRetrying evaluates a test case, restarting the sandboxes of the worker and trying again if they fail.
+func (e *Evaluator) evaluateCaseRetrying(ctx context.Context, w *worker, tc *apipb.TestCase, tcPath string, tg *apipb.TestGroup, lim caseLimits) (*apipb.Result, error) {
+	for attempt := 0; ; attempt++ {
+		res, err := e.evaluateCase(w, tc, tcPath, tg, lim)
+		if err == nil {
+			e.checkCaseScore(res, tg)
+		}
+		if err == nil || !sandboxFailed(err) || attempt == maxSandboxRetries || ctx.Err() != nil {
+			return res, err
+		}
+		logger.Warningf("sandbox failed on case %s, retrying: %v", tc.Name, err)
+		if err := w.restart(); err != nil {
+			return nil, err
 		}
 	}
-	return res, nil
 }
 
-func (e *Evaluator) evaluateCase(tc *apipb.TestCase, tg *apipb.TestGroup) (*apipb.Result, error) {
-	if e.plan.PlanType == apipb.EvaluationType_INTERACTIVE {
-		return e.evaluateInteractive(tc, tg)
+// evaluateCase evaluates a test case, keeping the output of the program in the given directory.
+func (e *Evaluator) evaluateCase(w *worker, tc *apipb.TestCase, tcPath string, tg *apipb.TestGroup, lim caseLimits) (*apipb.Result, error) {
+	if e.interactive() {
+		return e.evaluateInteractive(w, tc, tcPath, tg, lim)
+	}
+	outPath, err := w.linker.PathFor("output", true)
+	if err != nil {
+		return nil, err
 	}
-	outPath := e.linker.PathFor("output", true)
 	res := &apipb.Result{
 		Type: apipb.ResultType_TEST_CASE,
 	}
-	tcPath := filepath.Join(e.root, fmt.Sprintf("case-%s", tc.Name))
-	exit, err := e.runSubmission(tcPath, tc.InputPath)
+	exit, err := e.runSubmission(w, tcPath, tc.InputPath, lim)
 	if err != nil {
-		return res, fmt.Errorf("sandbox fail: %v, logs %v", err, e.programSandbox.logs())
+		return res, fmt.Errorf("sandbox fail: %w", err)
 	}
-	if exit.Crashed() {
+	if e.exceededMemory(exit, lim) {
+		res.Verdict = apipb.Verdict_MEMORY_LIMIT_EXCEEDED
+	} else if e.exceededOutput(exit, tcPath) {
+		res.Verdict = apipb.Verdict_OUTPUT_LIMIT_EXCEEDED
+	} else if exit.Crashed() {
 		res.Verdict = apipb.Verdict_RUN_TIME_ERROR
-	} else if exit.TimedOut() {
+	} else if e.exceededTime(exit, lim) {
 		res.Verdict = apipb.Verdict_TIME_LIMIT_EXCEEDED
-	} else {
-		ac := false
-		if e.evalSandbox != nil {
-			valOutput, err := e.runValidator(tg.OutputValidatorFlags, tc.InputPath, outPath, tc.OutputPath)
-			if err != nil {
-				return res, fmt.Errorf("failed validator run: %v", err)
-			}
-			ac = valOutput.Accepted
-			res.Message = valOutput.JudgeMessage
-			if e.plan.ScoringValidator && valOutput.HasScore {
-				res.Score = valOutput.Score
-			} else if ac {
-				res.Score = tg.AcceptScore
-			} else {
-				res.Score = tg.RejectScore
+	} else if w.evalSandbox != nil {
+		valOutput, err := e.runValidator(w, tg.OutputValidatorFlags, tc.InputPath, outPath, tc.OutputPath)
+		if err != nil {
+			if !setJudgeError(res, err) {
+				return res, fmt.Errorf("failed validator run: %w", err)
 			}
 		} else {
-			diff, err := diffOutput(tc.OutputPath, outPath, tg.OutputValidatorFlags)
-			if err != nil {
-				return res, fmt.Errorf("default validator failed: %v", err)
-			}
-			ac = diff.Match
-			res.Message = diff.Description
-			if ac {
-				res.Score = tg.AcceptScore
-			} else {
-				res.Score = tg.RejectScore
-			}
+			res.Message = valOutput.JudgeMessage
+			res.Feedback = valOutput.Feedback
+			e.setValidatorVerdict(res, valOutput, tg)
 		}
-
-		if ac {
-			res.Verdict = apipb.Verdict_ACCEPTED
-		} else {
-			res.Verdict = apipb.Verdict_WRONG_ANSWER
+	} else {
+		diff, err := diffOutput(tc.OutputPath, outPath, tg.OutputValidatorFlags)
+		if err != nil {
+			return res, fmt.Errorf("default validator failed: %v", err)
 		}
+		res.Message = diff.Description
+		e.setValidatorVerdict(res, &ValidatorOutput{Accepted: diff.Match}, tg)
 	}
 	res.TimeUsageMs = exit.TimeUsageMs
-	if err := e.linker.Clear(); err != nil {
+	res.WallTimeUsageMs = exit.WallTimeUsageMs
+	res.MemoryUsageKb = exit.MemoryUsageKb
+	res.KillReason = exit.killReason()
+	if res.Verdict == apipb.Verdict_RUN_TIME_ERROR || res.Verdict == apipb.Verdict_MEMORY_LIMIT_EXCEEDED {
+		outOfMemory := res.Verdict == apipb.Verdict_MEMORY_LIMIT_EXCEEDED
+		res.RunTimeError = runTimeError(exit, outOfMemory, e.plan.Program.Language, filepath.Join(tcPath, "error"))
+	}
+	if res.Output, err = e.captureOutput(filepath.Join(tcPath, "output"), filepath.Join(tcPath, "error")); err != nil {
+		return nil, err
+	}
+	if err := w.linker.Clear(); err != nil {
 		return nil, fmt.Errorf("failed clearing program env: %v", err)
 	}
-	if e.valLinker != nil {
-		if err := e.valLinker.Clear(); err != nil {
+	if w.valLinker != nil {
+		if err := w.valLinker.Clear(); err != nil {
 			return nil, fmt.Errorf("failed clearing validator env: %v", err)
 		}
 	}
-	e.resultChan <- res
 	logger.Infof("finished test case %s: %v", tc.Name, res)
 	return res, nil
 }
 
-func (e *Evaluator) runSubmission(tcPath, inputPath string) (*execResult, error) {
+// exceededTime checks whether a submission run should be judged as exceeding the time limit. This includes runs killed
+// for using too much wall-clock time even when the time limit applies to CPU time, since those never finish.
+func (e *Evaluator) exceededTime(exit *execResult, lim caseLimits) bool {
+	if exit.TimedOut() {
+		return true
+	}
+	return e.plan.TimeLimitMode == apipb.TimeLimitMode_WALL_TIME_LIMIT && lim.timeLimitMs > 0 &&
+		exit.WallTimeUsageMs > int64(lim.timeLimitMs)
+}
+
+// exceededMemory checks whether a submission run should be judged as exceeding the memory limit. Apart from runs
+// killed by the OOM killer, this includes runs that crashed after reaching the limit, such as when an allocation fails.
+func (e *Evaluator) exceededMemory(exit *execResult, lim caseLimits) bool {
+	if exit.MemoryExceeded() {
+		return true
+	}
+	return exit.Crashed() && lim.memLimitKb > 0 && exit.MemoryUsageKb >= int64(lim.memLimitKb)
+}
+
+// exceededOutput checks whether a submission run should be judged as exceeding the output limit. Apart from runs
+// killed by SIGXFSZ, this includes runs that crashed after their output or error file reached the limit, which
+// happens when the program ignores the signal and fails on the write error instead.
+func (e *Evaluator) exceededOutput(exit *execResult, tcPath string) bool {
+	if e.plan.OutputLimitKb == 0 {
+		return false
+	}
+	if exit.OutputExceeded() {
+		return true
+	}
+	if !exit.Crashed() {
+		return false
+	}
+	for _, name := range []string{"output", "error"} {
+		info, err := os.Stat(filepath.Join(tcPath, name))
+		if err == nil && info.Size() >= int64(e.plan.OutputLimitKb)*1024 {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *Evaluator) runSubmission(w *worker, tcPath, inputPath string, lim caseLimits) (*execResult, error) {
 	fb := util.NewFileBase(tcPath)
 	fb.OwnerGid = util.OmogenexecGroupId()
 	fb.GroupWritable = true
 	if err := os.MkdirAll(tcPath, 0755); err != nil {
 		return nil, err
 	}
-	if err := e.linker.LinkFile(inputPath, "input", false); err != nil {
+	if err := w.linker.LinkFile(inputPath, "input", false); err != nil {
 		return nil, err
 	}
 	if err := fb.WriteFile("output", []byte{}); err != nil {
 		return nil, err
 	}
-	if err := e.linker.LinkFile(tcPath+"/output", "output", true); err != nil {
+	if err := w.linker.LinkFile(tcPath+"/output", "output", true); err != nil {
 		return nil, err
 	}
 	if err := fb.WriteFile("error", []byte{}); err != nil {
 		return nil, err
 	}
-	if err := e.linker.LinkFile(tcPath+"/error", "error", true); err != nil {
+	if err := w.linker.LinkFile(tcPath+"/error", "error", true); err != nil {
 		return nil, err
 	}
-	return e.programSandbox.Run(e.plan.Program.RunCommand)
+	return w.programSandbox.RunWith(e.plan.Program.RunCommand, e.runOptions(lim))
 }
 
 type ValidatorOutput struct {
@@ -618,59 +1427,60 @@ type ValidatorOutput struct {
 	HasScore     bool
 	Score        float64
 	JudgeMessage string
+	Feedback     *apipb.ValidatorFeedback
 }
 
 const (
 	judgeMessageFile = "judgemessage.txt"
+	teamMessageFile  = "teammessage.txt"
+	judgeErrorFile   = "judgeerror.txt"
+	diffPositionFile = "diffposition.txt"
 	scoreFile        = "score.txt"
+	nextPassFile     = "nextpass.in"
 )
 
-func (e *Evaluator) runValidator(groupFlags []string, inpath, teampath, anspath string) (*ValidatorOutput, error) {
-	if err := e.valLinker.LinkFile(inpath, "input", false); err != nil {
+func (e *Evaluator) runValidator(w *worker, groupFlags []string, inpath, teampath, anspath string) (*ValidatorOutput, error) {
+	if err := w.valLinker.LinkFile(inpath, "input", false); err != nil {
 		return nil, err
 	}
-	if err := e.valLinker.LinkFile(teampath, "team_output", false); err != nil {
+	if err := w.valLinker.LinkFile(teampath, "team_output", false); err != nil {
 		return nil, err
 	}
-	if err := e.valLinker.LinkFile(anspath, "judge_answer", false); err != nil {
+	if err := w.valLinker.LinkFile(anspath, "judge_answer", false); err != nil {
 		return nil, err
 	}
 
-	exit, err := e.evalSandbox.Run(e.validatorCommand(groupFlags))
+	exit, err := w.evalSandbox.Run(w.validatorCommand(groupFlags))
 	if err != nil {
 		return nil, err
 	}
-	return e.validatorOutputFromExit(exit)
+	return e.validatorOutputFromExit(w, exit)
 }
 
-func (e *Evaluator) validatorOutputFromExit(exit *execResult) (*ValidatorOutput, error) {
+func (e *Evaluator) validatorOutputFromExit(w *worker, exit *execResult) (*ValidatorOutput, error) {
 	output := &ValidatorOutput{}
-	if exit.TimedOut() {
-		return nil, fmt.Errorf("output validator timed out")
-	}
 	if exit.CrashedWith(exitCodeAc) {
 		output.Accepted = true
 	} else if exit.CrashedWith(exitCodeWa) {
 		output.Accepted = false
 	} else {
 		// Crash was abnormal
-		dat, err := e.valLinker.writeBase.ReadFile("error")
-		if err != nil {
-			return nil, fmt.Errorf("could not read crashed output validator errors: %v", err)
-		}
-		dat2, err := e.valLinker.writeBase.ReadFile("output")
-		if err != nil {
-			return nil, fmt.Errorf("could not read crashed output validator output: %v", err)
+		return nil, &judgeError{
+			msg:      fmt.Sprintf("output validator %s", exit.description()),
+			feedback: readFailedFeedback(w.valLinker.writeBase),
 		}
-		return nil, fmt.Errorf("output validator crashed (err: %s, output: %s)", string(dat), string(dat2))
 	}
-	judgeMessage, err := e.valLinker.writeBase.ReadFile(judgeMessageFile)
-	if err == nil {
-		output.JudgeMessage = string(judgeMessage)
+	feedback, err := readFeedback(w.valLinker.writeBase)
+	if err != nil {
+		return nil, fmt.Errorf("could not read output validator feedback: %v", err)
+	}
+	output.Feedback = feedback
+	if feedback.JudgeMessage != "" {
+		output.JudgeMessage = feedback.JudgeMessage
 		logger.Infof("output validator message: %s", output.JudgeMessage)
 	}
 	if e.plan.ScoringValidator && output.Accepted {
-		scoreBytes, err := e.valLinker.writeBase.ReadFile(scoreFile)
+		scoreBytes, err := w.valLinker.writeBase.ReadFile(scoreFile)
 		scoreStr := strings.TrimSpace(string(scoreBytes))
 		if err != nil {
 			output.HasScore = false
@@ -678,22 +1488,35 @@ func (e *Evaluator) validatorOutputFromExit(exit *execResult) (*ValidatorOutput,
 		} else {
 			score, err := strconv.ParseFloat(scoreStr, 64)
 			if err != nil {
-				return nil, fmt.Errorf("could not parse score %s from scoring validator %v", scoreStr, err)
+				return nil, &judgeError{
+					msg:      fmt.Sprintf("could not parse score %s from scoring validator: %v", scoreStr, err),
+					feedback: readFailedFeedback(w.valLinker.writeBase),
+				}
 			}
 			output.Score = score
 			output.HasScore = true
 		}
 	}
+	if e.plan.RelativeScoring != nil && output.Accepted {
+		if !output.HasScore {
+			return nil, &judgeError{
+				msg:      "scoring validator reported no objective value",
+				feedback: output.Feedback,
+			}
+		}
+		answerPath, err := w.valLinker.PathFor("judge_answer", false)
+		if err != nil {
+			return nil, err
+		}
+		score, err := relativeScore(e.plan.RelativeScoring, output.Score, answerPath)
+		if err != nil {
+			return nil, &judgeError{msg: err.Error(), feedback: output.Feedback}
+		}
+		output.Score = score
+	}
 	return output, nil
 }
 
-func (e *Evaluator) validatorCommand(groupFlags []string) []string {
-	var flags []string
-	flags = append(flags, e.validatorCommandTemplate...)
-	flags = append(flags, groupFlags...)
-	return flags
-}
-
 func diffOutput(refPath, outPath string, args []string) (*DiffResult, error) {
 	refFile, err := os.Open(refPath)
 	if err != nil {
@@ -0,0 +1,182 @@
+package eval
+
+import (
+	"context"
+	"fmt"
+	apipb "github.com/jsannemo/omogenexec/api"
+	"google.golang.org/protobuf/proto"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestDefaultGraderScoring(t *testing.T) {
+	results := []*apipb.Result{
+		{Verdict: apipb.Verdict_ACCEPTED, Score: 1, Weight: 1},
+		{Verdict: apipb.Verdict_ACCEPTED, Score: 1, Weight: 3},
+		{Verdict: apipb.Verdict_WRONG_ANSWER, Score: 0, Weight: 4},
+	}
+	tests := []struct {
+		mode apipb.ScoringMode
+		want float64
+	}{
+		{apipb.ScoringMode_MIN, 0},
+		{apipb.ScoringMode_MAX, 1},
+		{apipb.ScoringMode_SUM, 2},
+		{apipb.ScoringMode_AVG, 2},
+		{apipb.ScoringMode_WEIGHTED_SUM, 4},
+		{apipb.ScoringMode_WEIGHTED_AVG, 0.5},
+	}
+	for _, tt := range tests {
+		tg := &apipb.TestGroup{ScoringMode: tt.mode, VerdictMode: apipb.VerdictMode_WORST_ERROR}
+		res := defaultGrader(results, tg)
+		if math.Abs(res.Score-tt.want) > 1e-9 {
+			t.Errorf("%v: score %v, want %v", tt.mode, res.Score, tt.want)
+		}
+		if res.Verdict != apipb.Verdict_WRONG_ANSWER {
+			t.Errorf("%v: verdict %v, want WRONG_ANSWER", tt.mode, res.Verdict)
+		}
+	}
+}
+
+func TestZeroWeight(t *testing.T) {
+	if w := weight(nil); w != 1 {
+		t.Errorf("unset weight is %v, want 1", w)
+	}
+	if w := weight(proto.Float64(0)); w != 0 {
+		t.Errorf("zero weight is %v, want 0", w)
+	}
+	results := []*apipb.Result{
+		{Verdict: apipb.Verdict_ACCEPTED, Score: 1, Weight: weight(nil)},
+		{Verdict: apipb.Verdict_WRONG_ANSWER, Score: 0, Weight: weight(proto.Float64(0))},
+	}
+	tg := &apipb.TestGroup{ScoringMode: apipb.ScoringMode_WEIGHTED_AVG}
+	if res := defaultGrader(results, tg); res.Score != 1 {
+		t.Errorf("score %v with a failed test case of weight 0, want 1", res.Score)
+	}
+}
+
+func TestCheckGroup(t *testing.T) {
+	sample := &apipb.TestGroup{Name: "sample", IsSample: true}
+	secret := &apipb.TestGroup{Name: "secret", Cases: []*apipb.TestCase{{Name: "1", Weight: proto.Float64(2)}}}
+	if err := checkGroup(&apipb.TestGroup{IgnoreSample: true, Groups: []*apipb.TestGroup{sample, secret}}, ""); err != nil {
+		t.Errorf("valid plan rejected: %v", err)
+	}
+	if err := checkGroup(&apipb.TestGroup{IgnoreSample: true, Groups: []*apipb.TestGroup{secret}}, ""); err == nil {
+		t.Errorf("ignore_sample without a sample group accepted")
+	}
+	negative := &apipb.TestGroup{Name: "g", Cases: []*apipb.TestCase{{Name: "1", Weight: proto.Float64(-1)}}}
+	if err := checkGroup(&apipb.TestGroup{Groups: []*apipb.TestGroup{negative}}, ""); err == nil {
+		t.Errorf("negative weight accepted")
+	}
+}
+
+func TestJudgeErrorAfterBreakIsRecorded(t *testing.T) {
+	e := &Evaluator{plan: &apipb.EvaluationPlan{
+		EvaluateAfterBreak: true,
+		JudgeErrorPolicy:   apipb.JudgeErrorPolicy_CONTINUE,
+	}}
+	q := &caseQueue{e: e, tg: &apipb.TestGroup{BreakOnFail: true}}
+	wa := &apipb.Result{Verdict: apipb.Verdict_WRONG_ANSWER}
+	je := &apipb.Result{Verdict: apipb.Verdict_JUDGE_ERROR, Ungraded: true}
+	q.record(wa)
+	q.record(je)
+	if len(q.results) != 1 || q.results[0] != wa {
+		t.Errorf("graded results %v, want only the first failure", q.results)
+	}
+	if got := firstJudgeError(q.recorded); got != je {
+		t.Errorf("judge error after the break not found among recorded results, got %v", got)
+	}
+}
+
+func TestDuplicateCasesAreReported(t *testing.T) {
+	results := make(chan *apipb.Result, 2)
+	e := &Evaluator{
+		plan:          &apipb.EvaluationPlan{},
+		evalCache:     make(map[string]*apipb.Result),
+		resultChan:    results,
+		retainedCases: make(map[string]bool),
+	}
+	tg := &apipb.TestGroup{Name: "g", AcceptScore: 1}
+	cases := []*apipb.TestCase{
+		{Name: "a", InputPath: "/1.in", OutputPath: "/1.ans"},
+		{Name: "b", InputPath: "/1.in", OutputPath: "/1.ans", Weight: proto.Float64(2)},
+	}
+	key, err := e.cacheKey(cases[0], tg, e.planLimits())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both test cases reuse the result of an earlier test case with the same files.
+	e.evalCache[key] = &apipb.Result{Type: apipb.ResultType_TEST_CASE, Verdict: apipb.Verdict_ACCEPTED, Name: "other"}
+	q := &caseQueue{ctx: context.Background(), e: e, tg: tg, path: "g", limits: e.planLimits()}
+	for _, tc := range cases {
+		if err := q.add(tc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.collect(true); err != nil {
+		t.Fatal(err)
+	}
+	close(results)
+	var got []string
+	for res := range results {
+		got = append(got, fmt.Sprintf("%s %s %v %v", res.Name, res.Path, res.Score, res.Weight))
+	}
+	want := []string{"a g/a 1 1", "b g/b 1 2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("reported %q, want %q", got, want)
+	}
+}
+
+func TestJudgeErrorScore(t *testing.T) {
+	res := &apipb.Result{Verdict: apipb.Verdict_WRONG_ANSWER, Score: 5}
+	if !setJudgeError(res, &judgeError{msg: "validator crashed"}) || res.Score != 0 {
+		t.Errorf("judge error got score %v, want 0", res.Score)
+	}
+	// The judge error counts the same whether or not the group stops early.
+	for _, mode := range []apipb.EarlyTermination{apipb.EarlyTermination_EVALUATE_ALL, apipb.EarlyTermination_STOP_WHEN_RESULT_DETERMINED} {
+		e := &Evaluator{plan: &apipb.EvaluationPlan{EarlyTermination: mode, JudgeErrorPolicy: apipb.JudgeErrorPolicy_CONTINUE}}
+		tg := &apipb.TestGroup{AcceptScore: 10, RejectScore: 5, ScoringMode: apipb.ScoringMode_MIN, VerdictMode: apipb.VerdictMode_FIRST_ERROR}
+		q := &caseQueue{e: e, tg: tg}
+		q.record(&apipb.Result{Type: apipb.ResultType_TEST_CASE, Verdict: apipb.Verdict_JUDGE_ERROR})
+		if q.broken {
+			t.Errorf("%v: judge error stopped a group whose plan continues after judge errors", mode)
+		}
+		q.record(&apipb.Result{Type: apipb.ResultType_TEST_CASE, Verdict: apipb.Verdict_WRONG_ANSWER, Score: 5})
+		if want := mode != apipb.EarlyTermination_EVALUATE_ALL; q.broken != want {
+			t.Errorf("%v: stopped = %v after a failure, want %v", mode, q.broken, want)
+		}
+		failed := firstJudgeError(q.recorded)
+		if failed == nil {
+			t.Fatalf("%v: judge error not recorded", mode)
+		}
+		if groupRes := judgeErrorGroupResult(failed); groupRes.Verdict != apipb.Verdict_JUDGE_ERROR || groupRes.Score != 0 {
+			t.Errorf("%v: group result %v with score %v, want JUDGE_ERROR with score 0", mode, groupRes.Verdict, groupRes.Score)
+		}
+	}
+}
+
+func TestSkippedIsNeverWorse(t *testing.T) {
+	for v := range apipb.Verdict_name {
+		verdict := apipb.Verdict(v)
+		if verdict == apipb.Verdict_VERDICT_UNSPECIFIED || verdict == apipb.Verdict_SKIPPED {
+			continue
+		}
+		if worseness(apipb.Verdict_SKIPPED) >= worseness(verdict) {
+			t.Errorf("SKIPPED is as bad as %v", verdict)
+		}
+	}
+	if verdictToAbbreviation(apipb.Verdict_SKIPPED) == "" {
+		t.Errorf("SKIPPED has no abbreviation")
+	}
+	results := []*apipb.Result{
+		{Verdict: apipb.Verdict_ACCEPTED, Score: 1, Weight: 1},
+		{Verdict: apipb.Verdict_SKIPPED, Score: 1, Weight: 1},
+	}
+	for _, mode := range []apipb.VerdictMode{apipb.VerdictMode_WORST_ERROR, apipb.VerdictMode_FIRST_ERROR} {
+		res := defaultGrader(results, &apipb.TestGroup{ScoringMode: apipb.ScoringMode_SUM, VerdictMode: mode})
+		if res.Verdict != apipb.Verdict_ACCEPTED || res.Score != 1 {
+			t.Errorf("%v: skipped result counted, got %v with score %v", mode, res.Verdict, res.Score)
+		}
+	}
+}
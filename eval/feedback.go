@@ -0,0 +1,104 @@
+package eval
+
+import (
+	"fmt"
+	"github.com/google/logger"
+	apipb "github.com/jsannemo/omogenexec/api"
+	"github.com/jsannemo/omogenexec/util"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	// maxFeedbackFileBytes is the number of bytes kept of each feedback file.
+	maxFeedbackFileBytes = 64 * 1024
+	// maxFeedbackBytes is the total number of bytes kept of all feedback files of a validator run.
+	maxFeedbackBytes = 1024 * 1024
+)
+
+// readFeedback collects the files an output validator wrote to its feedback directory. The standard output and error
+// of the validator are kept in the same directory, and are not considered feedback, nor is the input of the next pass
+// of a MULTI_PASS evaluation.
+func readFeedback(fb *util.FileBase) (*apipb.ValidatorFeedback, error) {
+	entries, err := ioutil.ReadDir(fb.Path())
+	if err != nil {
+		return nil, err
+	}
+	// Files are read in name order, so that the same files are truncated each time.
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	feedback := &apipb.ValidatorFeedback{}
+	remaining := maxFeedbackBytes
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Mode().IsRegular() || name == "output" || name == "error" || name == nextPassFile {
+			continue
+		}
+		limit := maxFeedbackFileBytes
+		if remaining < limit {
+			limit = remaining
+		}
+		dat, truncated, err := readPrefix(filepath.Join(fb.Path(), name), limit)
+		if err != nil {
+			return nil, fmt.Errorf("failed reading %s: %v", name, err)
+		}
+		remaining -= len(dat)
+		if truncated {
+			feedback.TruncatedFiles = append(feedback.TruncatedFiles, name)
+		}
+		switch name {
+		case judgeMessageFile:
+			feedback.JudgeMessage = string(dat)
+		case teamMessageFile:
+			feedback.TeamMessage = string(dat)
+		case judgeErrorFile:
+			feedback.JudgeError = string(dat)
+		case diffPositionFile:
+			feedback.DiffPosition = string(dat)
+		default:
+			if feedback.Files == nil {
+				feedback.Files = make(map[string][]byte)
+			}
+			feedback.Files[name] = dat
+		}
+	}
+	return feedback, nil
+}
+
+// readFailedFeedback is like readFeedback, but also keeps the standard output and error of the validator, to help
+// diagnose why it failed. Since the feedback is only used to describe the failure, errors reading it are ignored.
+func readFailedFeedback(fb *util.FileBase) *apipb.ValidatorFeedback {
+	feedback, err := readFeedback(fb)
+	if err != nil {
+		logger.Warningf("failed reading feedback of failed validator: %v", err)
+		feedback = &apipb.ValidatorFeedback{}
+	}
+	if dat, _, err := readPrefix(filepath.Join(fb.Path(), "output"), maxFeedbackFileBytes); err == nil {
+		feedback.ValidatorOutput = dat
+	}
+	if dat, _, err := readPrefix(filepath.Join(fb.Path(), "error"), maxFeedbackFileBytes); err == nil {
+		feedback.ValidatorError = dat
+	}
+	return feedback
+}
+
+// readPrefix reads at most limit bytes from the start of a file, and reports whether the file was longer than that.
+func readPrefix(path string, limit int) ([]byte, bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+	dat, err := ioutil.ReadAll(io.LimitReader(f, int64(limit)+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if len(dat) > limit {
+		return dat[:limit], true, nil
+	}
+	return dat, false, nil
+}
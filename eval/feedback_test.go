@@ -0,0 +1,46 @@
+package eval
+
+import (
+	"bytes"
+	"github.com/jsannemo/omogenexec/util"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadFeedback(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string][]byte{
+		judgeMessageFile: []byte("judge"),
+		teamMessageFile:  []byte("team"),
+		judgeErrorFile:   []byte("error"),
+		diffPositionFile: []byte("12"),
+		"output":         []byte("validator stdout"),
+		"error":          []byte("validator stderr"),
+		"extra.txt":      []byte("extra"),
+		nextPassFile:     []byte("next pass input"),
+		"large.txt":      bytes.Repeat([]byte("x"), maxFeedbackFileBytes+1),
+	}
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fb := util.NewFileBase(dir)
+	feedback, err := readFeedback(&fb)
+	if err != nil {
+		t.Fatalf("failed reading feedback: %v", err)
+	}
+	if feedback.JudgeMessage != "judge" || feedback.TeamMessage != "team" || feedback.JudgeError != "error" || feedback.DiffPosition != "12" {
+		t.Errorf("wrong feedback messages: %v", feedback)
+	}
+	if len(feedback.Files) != 2 || string(feedback.Files["extra.txt"]) != "extra" {
+		t.Errorf("wrong feedback files: %v", feedback.Files)
+	}
+	if len(feedback.Files["large.txt"]) != maxFeedbackFileBytes {
+		t.Errorf("large file not truncated, got %d bytes", len(feedback.Files["large.txt"]))
+	}
+	if len(feedback.TruncatedFiles) != 1 || feedback.TruncatedFiles[0] != "large.txt" {
+		t.Errorf("wrong truncated files: %v", feedback.TruncatedFiles)
+	}
+}
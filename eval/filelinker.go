@@ -1,7 +1,7 @@
 package eval
 
 import (
-	"github.com/google/logger"
+	"fmt"
 
 	"github.com/jsannemo/omogenexec/util"
 )
@@ -54,13 +54,27 @@ func (fl *fileLinker) base(writeable bool) *util.FileBase {
 	}
 }
 
-// PathFor returns the path that a file will get inside the linker.
-func (fl *fileLinker) PathFor(inName string, writeable bool) string {
-	str, err := fl.base(writeable).FullPath(inName)
+// PathFor returns the path that a file will get inside the linker. It fails if the name traverses upwards out of the
+// linker.
+func (fl *fileLinker) PathFor(inName string, writeable bool) (string, error) {
+	path, err := fl.base(writeable).FullPath(inName)
 	if err != nil {
-		logger.Fatalf("Tried to use an env with relative path: %v", err)
+		return "", fmt.Errorf("invalid linker path: %v", err)
 	}
-	return str
+	return path, nil
+}
+
+// streamPaths returns the paths of the standard streams of a program run in the linker, which reads the file inName
+// and writes the files output and error.
+func (fl *fileLinker) streamPaths(inName string) (input, output, errorPath string, err error) {
+	if input, err = fl.PathFor(inName, false); err != nil {
+		return
+	}
+	if output, err = fl.PathFor("output", true); err != nil {
+		return
+	}
+	errorPath, err = fl.PathFor("error", true)
+	return
 }
 
 // LinkFile hard links the file path into the inside root.
@@ -68,6 +82,11 @@ func (fl *fileLinker) LinkFile(path, inName string, writeable bool) error {
 	return fl.base(writeable).LinkInto(path, inName)
 }
 
+// ClearReadable removes the read-only files, keeping the files written by earlier executions.
+func (fl *fileLinker) ClearReadable() error {
+	return fl.readBase.RemoveContents(".")
+}
+
 // Clear resets the environment for a new execution.
 func (fl *fileLinker) Clear() error {
 	rerr := fl.readBase.RemoveContents(".")
@@ -0,0 +1,20 @@
+package eval
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/jsannemo/omogenexec/util"
+)
+
+func TestPathFor(t *testing.T) {
+	dir := t.TempDir()
+	read, write := util.NewFileBase(filepath.Join(dir, "read")), util.NewFileBase(filepath.Join(dir, "write"))
+	fl := &fileLinker{readBase: &read, writeBase: &write}
+	if path, err := fl.PathFor("output", true); err != nil || path != filepath.Join(dir, "write", "output") {
+		t.Errorf("PathFor(output) = %q, %v", path, err)
+	}
+	if path, err := fl.PathFor("../write/output", false); err == nil {
+		t.Errorf("PathFor of a path traversing upwards = %q, want error", path)
+	}
+}
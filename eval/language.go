@@ -1,6 +1,7 @@
 package eval
 
 import (
+	"context"
 	"fmt"
 	"github.com/google/logger"
 	apipb "github.com/jsannemo/omogenexec/api"
@@ -230,15 +231,15 @@ func runCommandInSandbox(command []string, lang apipb.LanguageGroup) (string, er
 		MemoryLimitKb: 500_000,
 	}
 	setLanguageSandbox(&args, lang)
-	sandbox := newSandbox(0, args)
-	if err := sandbox.Start(); err != nil {
+	sandbox := newSandbox(args)
+	if err := sandbox.Start(context.Background()); err != nil {
 		return "", fmt.Errorf("couldn't start version sandbox: %v", err)
 	}
 	run, err := sandbox.Run(command)
+	sandbox.Finish()
 	if err != nil {
 		return "", fmt.Errorf("failed running %v", err)
 	}
-	sandbox.Finish()
 	outputLine, _ := firstLine(outputPath)
 	errorLine, _ := firstLine(errorPath)
 	if run.Crashed() || run.TimedOut() {
@@ -0,0 +1,133 @@
+package eval
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// sandboxProtocolVersion is the version of the protocol spoken with the sandbox binary. The sandbox announces its
+// version in a handshake when it starts, and must match this version exactly.
+const sandboxProtocolVersion = 2
+
+// maxMessageBytes bounds the size of messages in both directions. Messages read from the sandbox are bounded to avoid
+// allocating arbitrary amounts of memory on corrupt output.
+const maxMessageBytes = 16 * 1024 * 1024
+
+// errMessageTooLarge is wrapped by the error returned when writing a message larger than maxMessageBytes. Nothing is
+// written then, so the stream stays usable.
+var errMessageTooLarge = errors.New("message too large")
+
+type messageField struct {
+	key   string
+	value string
+}
+
+// A sandboxMessage is a message of the sandbox protocol: a list of key-value fields, where keys may repeat.
+//
+// Messages are written as their length as a 32-bit big-endian integer followed by the fields. Every key and value of
+// a field is in turn written as its length followed by its contents.
+type sandboxMessage struct {
+	fields []messageField
+}
+
+func (m *sandboxMessage) add(key, value string) {
+	m.fields = append(m.fields, messageField{key, value})
+}
+
+func (m *sandboxMessage) addInt(key string, value int64) {
+	m.add(key, strconv.FormatInt(value, 10))
+}
+
+// get returns the first value of the given key.
+func (m *sandboxMessage) get(key string) (string, bool) {
+	for _, field := range m.fields {
+		if field.key == key {
+			return field.value, true
+		}
+	}
+	return "", false
+}
+
+// getInt returns the first value of the given key as an integer. A missing key is returned as 0.
+func (m *sandboxMessage) getInt(key string) (int64, error) {
+	value, found := m.get(key)
+	if !found {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %q", key, value)
+	}
+	return n, nil
+}
+
+func writeMessage(w io.Writer, msg *sandboxMessage) error {
+	var payload []byte
+	for _, field := range msg.fields {
+		payload = appendString(payload, field.key)
+		payload = appendString(payload, field.value)
+	}
+	// The sandbox rejects messages as large as those readMessage rejects, so they are caught here with a clearer error.
+	if len(payload) > maxMessageBytes {
+		return fmt.Errorf("%w: %d bytes is more than the limit of %d bytes", errMessageTooLarge, len(payload), maxMessageBytes)
+	}
+	frame := make([]byte, 4, 4+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	_, err := w.Write(append(frame, payload...))
+	return err
+}
+
+func appendString(buf []byte, s string) []byte {
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(s)))
+	return append(append(buf, length[:]...), s...)
+}
+
+// readMessage reads the next message. If the reader ends before the message starts, io.EOF is returned; if it ends
+// within the message, io.ErrUnexpectedEOF is.
+func readMessage(r *bufio.Reader) (*sandboxMessage, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(length[:])
+	if size > maxMessageBytes {
+		return nil, fmt.Errorf("message of %d bytes is too large", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	msg := &sandboxMessage{}
+	for len(payload) > 0 {
+		var key, value string
+		var err error
+		if key, payload, err = takeString(payload); err != nil {
+			return nil, err
+		}
+		if value, payload, err = takeString(payload); err != nil {
+			return nil, err
+		}
+		msg.add(key, value)
+	}
+	return msg, nil
+}
+
+func takeString(payload []byte) (string, []byte, error) {
+	if len(payload) < 4 {
+		return "", nil, fmt.Errorf("truncated field length")
+	}
+	size := binary.BigEndian.Uint32(payload)
+	payload = payload[4:]
+	if uint32(len(payload)) < size {
+		return "", nil, fmt.Errorf("truncated field")
+	}
+	return string(payload[:size]), payload[size:], nil
+}
@@ -0,0 +1,74 @@
+package eval
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	msg := &sandboxMessage{}
+	msg.add("arg", "/usr/bin/python3")
+	msg.add("arg", "")
+	msg.add("arg", "with\x00nul")
+	msg.addInt("time_limit_ms", 1000)
+	var buf bytes.Buffer
+	if err := writeMessage(&buf, msg); err != nil {
+		t.Fatalf("writeMessage: %v", err)
+	}
+	if err := writeMessage(&buf, &sandboxMessage{}); err != nil {
+		t.Fatalf("writeMessage: %v", err)
+	}
+
+	r := bufio.NewReader(&buf)
+	got, err := readMessage(r)
+	if err != nil {
+		t.Fatalf("readMessage: %v", err)
+	}
+	if !reflect.DeepEqual(got, msg) {
+		t.Errorf("got %v, want %v", got, msg)
+	}
+	if limit, err := got.getInt("time_limit_ms"); err != nil || limit != 1000 {
+		t.Errorf("getInt(time_limit_ms) = %d, %v; want 1000", limit, err)
+	}
+	if empty, err := readMessage(r); err != nil || len(empty.fields) != 0 {
+		t.Errorf("readMessage = %v, %v; want empty message", empty, err)
+	}
+	if _, err := readMessage(r); err != io.EOF {
+		t.Errorf("readMessage at end = %v; want EOF", err)
+	}
+}
+
+func TestReadTruncatedMessage(t *testing.T) {
+	var buf bytes.Buffer
+	msg := &sandboxMessage{}
+	msg.add("status", "exited")
+	if err := writeMessage(&buf, msg); err != nil {
+		t.Fatalf("writeMessage: %v", err)
+	}
+	frame := buf.Bytes()
+	if _, err := readMessage(bufio.NewReader(bytes.NewReader(frame[:len(frame)-1]))); err != io.ErrUnexpectedEOF {
+		t.Errorf("readMessage of truncated frame = %v; want unexpected EOF", err)
+	}
+	// A frame whose length covers only part of a field.
+	corrupt := append([]byte{0, 0, 0, 6}, frame[4:10]...)
+	if _, err := readMessage(bufio.NewReader(bytes.NewReader(corrupt))); err == nil {
+		t.Errorf("readMessage of truncated field succeeded")
+	}
+}
+
+func TestWriteOversizedMessage(t *testing.T) {
+	msg := &sandboxMessage{}
+	msg.add("env", strings.Repeat("x", maxMessageBytes))
+	var buf bytes.Buffer
+	if err := writeMessage(&buf, msg); !errors.Is(err, errMessageTooLarge) {
+		t.Errorf("writeMessage of oversized message = %v; want errMessageTooLarge", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("writeMessage wrote %d bytes of an oversized message", buf.Len())
+	}
+}
@@ -0,0 +1,79 @@
+package eval
+
+import (
+	"bufio"
+	"fmt"
+	apipb "github.com/jsannemo/omogenexec/api"
+	"math"
+	"os"
+	"strconv"
+)
+
+// checkRelativeScoring verifies that the relative scoring of a plan, if any, can be used.
+func checkRelativeScoring(plan *apipb.EvaluationPlan) error {
+	rs := plan.RelativeScoring
+	if rs == nil {
+		return nil
+	}
+	if !plan.ScoringValidator || plan.Validator == nil {
+		return fmt.Errorf("relative scoring requires a scoring validator")
+	}
+	if rs.Direction != apipb.ObjectiveDirection_MAXIMIZE && rs.Direction != apipb.ObjectiveDirection_MINIMIZE {
+		return fmt.Errorf("relative scoring needs an objective direction")
+	}
+	return nil
+}
+
+// relativeScore compares the objective value of the program with the reference value in an answer file.
+func relativeScore(rs *apipb.RelativeScoring, value float64, answerPath string) (float64, error) {
+	reference, err := readReferenceValue(answerPath)
+	if err != nil {
+		return 0, err
+	}
+	if value < 0 || math.IsInf(value, 0) || math.IsNaN(value) {
+		return 0, fmt.Errorf("objective value %v from scoring validator is negative or not finite", value)
+	}
+	if reference <= 0 || math.IsInf(reference, 0) || math.IsNaN(reference) {
+		return 0, fmt.Errorf("reference value %v in answer file is not positive", reference)
+	}
+	if rs.Function == apipb.RelativeScoreFunction_LOG_RATIO {
+		value, reference = math.Log1p(value), math.Log1p(reference)
+	}
+	score := value / reference
+	if rs.Direction == apipb.ObjectiveDirection_MINIMIZE {
+		if value == 0 {
+			// The program beat the reference by an unbounded factor.
+			if !rs.Clamp {
+				return 0, fmt.Errorf("objective value 0 has no relative score when minimizing without clamping")
+			}
+			return 1, nil
+		}
+		score = reference / value
+	}
+	if rs.Clamp {
+		score = math.Max(0, math.Min(1, score))
+	}
+	return score, nil
+}
+
+// readReferenceValue reads the first number of an answer file.
+func readReferenceValue(path string) (float64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("could not read reference value: %v", err)
+	}
+	defer f.Close()
+	words := bufio.NewScanner(f)
+	words.Split(bufio.ScanWords)
+	if !words.Scan() {
+		if err := words.Err(); err != nil {
+			return 0, fmt.Errorf("could not read reference value: %v", err)
+		}
+		return 0, fmt.Errorf("answer file has no reference value")
+	}
+	reference, err := strconv.ParseFloat(words.Text(), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid reference value %q in answer file", words.Text())
+	}
+	return reference, nil
+}
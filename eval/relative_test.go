@@ -0,0 +1,65 @@
+package eval
+
+import (
+	apipb "github.com/jsannemo/omogenexec/api"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"testing"
+)
+
+func TestRelativeScore(t *testing.T) {
+	answer := filepath.Join(t.TempDir(), "1.ans")
+	if err := ioutil.WriteFile(answer, []byte("  100\n3 1 2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	maximize := apipb.ObjectiveDirection_MAXIMIZE
+	minimize := apipb.ObjectiveDirection_MINIMIZE
+	tests := []struct {
+		scoring *apipb.RelativeScoring
+		value   float64
+		want    float64
+	}{
+		{&apipb.RelativeScoring{Direction: maximize}, 50, 0.5},
+		{&apipb.RelativeScoring{Direction: maximize}, 150, 1.5},
+		{&apipb.RelativeScoring{Direction: maximize, Clamp: true}, 150, 1},
+		{&apipb.RelativeScoring{Direction: minimize}, 200, 0.5},
+		{&apipb.RelativeScoring{Direction: minimize, Clamp: true}, 50, 1},
+		{&apipb.RelativeScoring{Direction: maximize, Function: apipb.RelativeScoreFunction_LOG_RATIO}, 10, math.Log(11) / math.Log(101)},
+		{&apipb.RelativeScoring{Direction: minimize, Function: apipb.RelativeScoreFunction_LOG_RATIO}, 10, math.Log(101) / math.Log(11)},
+	}
+	for _, tt := range tests {
+		got, err := relativeScore(tt.scoring, tt.value, answer)
+		if err != nil {
+			t.Errorf("relativeScore(%v, %v) failed: %v", tt.scoring, tt.value, err)
+		} else if math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("relativeScore(%v, %v) = %v, want %v", tt.scoring, tt.value, got, tt.want)
+		}
+	}
+	if got, err := relativeScore(&apipb.RelativeScoring{Direction: maximize}, 0, answer); err != nil || got != 0 {
+		t.Errorf("relativeScore of a zero value when maximizing = %v, %v; want 0", got, err)
+	}
+	if got, err := relativeScore(&apipb.RelativeScoring{Direction: minimize, Clamp: true}, 0, answer); err != nil || got != 1 {
+		t.Errorf("relativeScore of a zero value when minimizing with clamping = %v, %v; want 1", got, err)
+	}
+	if _, err := relativeScore(&apipb.RelativeScoring{Direction: minimize}, 0, answer); err == nil {
+		t.Errorf("relativeScore accepted a zero value when minimizing without clamping")
+	}
+	if _, err := relativeScore(&apipb.RelativeScoring{Direction: maximize}, -1, answer); err == nil {
+		t.Errorf("relativeScore accepted a negative value")
+	}
+	nan := filepath.Join(t.TempDir(), "nan.ans")
+	if err := ioutil.WriteFile(nan, []byte("nan\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := relativeScore(&apipb.RelativeScoring{Direction: maximize}, 1, nan); err == nil {
+		t.Errorf("relativeScore accepted a NaN reference value")
+	}
+	empty := filepath.Join(t.TempDir(), "2.ans")
+	if err := ioutil.WriteFile(empty, []byte("\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := relativeScore(&apipb.RelativeScoring{Direction: maximize}, 1, empty); err == nil {
+		t.Errorf("relativeScore accepted an answer file without a reference value")
+	}
+}
@@ -0,0 +1,106 @@
+package eval
+
+import (
+	"fmt"
+	"github.com/google/logger"
+	apipb "github.com/jsannemo/omogenexec/api"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A RetentionPolicy decides which test case directories are kept in the root of an Evaluator once their test cases
+// are evaluated. The directory of a test case contains the output and error of the program, and the inputs of any
+// further passes of a MULTI_PASS evaluation.
+type RetentionPolicy int
+
+const (
+	// KeepAllCases keeps the directories of all test cases. This is the default.
+	KeepAllCases RetentionPolicy = iota
+	// KeepFailedCases keeps only the directories of test cases that were not accepted.
+	KeepFailedCases
+	// DeleteAllCases deletes the directories of all test cases.
+	DeleteAllCases
+)
+
+const caseDirPrefix = "case-"
+
+// SetRetention sets which test case directories are kept by the evaluation. If maxBytes is positive, directories are
+// only kept while their total size stays within it; the directories of later test cases are deleted instead.
+func (e *Evaluator) SetRetention(policy RetentionPolicy, maxBytes int64) {
+	e.retention = policy
+	e.retentionMaxBytes = maxBytes
+}
+
+// caseDir returns the directory of the test case with the given result path. Test case names are only unique within
+// their group, so the directory is named from the whole path, escaped to a single path element.
+func (e *Evaluator) caseDir(casePath string) string {
+	return filepath.Join(e.root, caseDirPrefix+url.PathEscape(casePath))
+}
+
+// retainCase applies the retention policy to the directory of a test case that has been evaluated.
+func (e *Evaluator) retainCase(dir string, res *apipb.Result) {
+	keep := e.retention == KeepAllCases || (e.retention == KeepFailedCases && res.Verdict != apipb.Verdict_ACCEPTED)
+	if keep && e.retentionMaxBytes > 0 {
+		size, err := dirSize(dir)
+		if err != nil {
+			logger.Warningf("failed computing size of %s: %v", dir, err)
+			return
+		}
+		if e.retainedBytes+size > e.retentionMaxBytes {
+			keep = false
+		} else {
+			e.retainedBytes += size
+		}
+	}
+	if keep {
+		e.retainedCases[filepath.Base(dir)] = true
+		return
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		logger.Warningf("failed removing test case directory %s: %v", dir, err)
+	}
+}
+
+// cleanCaseDirectories removes the directories of test cases that were not retained when they finished, such as those
+// of test cases whose evaluation was aborted.
+func (e *Evaluator) cleanCaseDirectories() {
+	if e.retention == KeepAllCases && e.retentionMaxBytes <= 0 {
+		return
+	}
+	entries, err := ioutil.ReadDir(e.root)
+	if err != nil {
+		logger.Warningf("failed listing test case directories: %v", err)
+		return
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), caseDirPrefix) || e.retainedCases[entry.Name()] {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(e.root, entry.Name())); err != nil {
+			logger.Warningf("failed removing test case directory %s: %v", entry.Name(), err)
+		}
+	}
+}
+
+func dirSize(path string) (int64, error) {
+	var size int64
+	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed walking %s: %v", path, err)
+	}
+	return size, nil
+}
@@ -0,0 +1,97 @@
+package eval
+
+import (
+	apipb "github.com/jsannemo/omogenexec/api"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRetention(t *testing.T) {
+	tests := []struct {
+		policy   RetentionPolicy
+		maxBytes int64
+		want     []string
+	}{
+		{KeepAllCases, 0, []string{"case-ac", "case-big", "case-wa"}},
+		{KeepFailedCases, 0, []string{"case-big", "case-wa"}},
+		{DeleteAllCases, 0, nil},
+		{KeepAllCases, 150, []string{"case-ac", "case-wa"}},
+	}
+	for _, test := range tests {
+		root := t.TempDir()
+		e := &Evaluator{root: root, retainedCases: make(map[string]bool)}
+		e.SetRetention(test.policy, test.maxBytes)
+		cases := []struct {
+			name    string
+			size    int
+			verdict apipb.Verdict
+		}{
+			{"ac", 100, apipb.Verdict_ACCEPTED},
+			{"big", 100, apipb.Verdict_WRONG_ANSWER},
+			{"wa", 10, apipb.Verdict_WRONG_ANSWER},
+			{"aborted", 10, apipb.Verdict_VERDICT_UNSPECIFIED},
+		}
+		for _, c := range cases {
+			dir := e.caseDir(c.name)
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(dir, "output"), make([]byte, c.size), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if c.name != "aborted" {
+				e.retainCase(dir, &apipb.Result{Verdict: c.verdict})
+			}
+		}
+		e.cleanCaseDirectories()
+
+		entries, err := ioutil.ReadDir(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, entry := range entries {
+			got = append(got, entry.Name())
+		}
+		if test.policy == KeepAllCases && test.maxBytes == 0 {
+			// Nothing is cleaned up when everything is kept.
+			test.want = append([]string{"case-aborted"}, test.want...)
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("policy %v, max %d: kept %v, want %v", test.policy, test.maxBytes, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("policy %v, max %d: kept %v, want %v", test.policy, test.maxBytes, got, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestRetentionOfCasesWithSameName(t *testing.T) {
+	root := t.TempDir()
+	e := &Evaluator{root: root, retainedCases: make(map[string]bool)}
+	e.SetRetention(KeepFailedCases, 0)
+	sample, secret := e.caseDir("sample/1"), e.caseDir("secret/1")
+	if sample == secret {
+		t.Fatalf("cases with the same name in different groups share directory %s", sample)
+	}
+	for _, dir := range []string{sample, secret} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e.retainCase(sample, &apipb.Result{Verdict: apipb.Verdict_WRONG_ANSWER})
+	e.retainCase(secret, &apipb.Result{Verdict: apipb.Verdict_ACCEPTED})
+	e.cleanCaseDirectories()
+	if _, err := os.Stat(sample); err != nil {
+		t.Errorf("failed case was not retained: %v", err)
+	}
+	if _, err := os.Stat(secret); !os.IsNotExist(err) {
+		t.Errorf("accepted case was retained: %v", err)
+	}
+}
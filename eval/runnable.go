@@ -1,5 +1,11 @@
 package eval
 
+import (
+	"fmt"
+	apipb "github.com/jsannemo/omogenexec/api"
+	"syscall"
+)
+
 // An exitType describes why a program exited.
 type exitType int
 
@@ -10,6 +16,11 @@ const (
 	signaled
 	// timedOut means the program was killed due to exceeding its Time limit.
 	timedOut
+	// wallTimedOut means the program was killed due to exceeding its wall-clock time limit while within its CPU time
+	// limit, e.g. because it was sleeping or blocked on input.
+	wallTimedOut
+	// memoryExceeded means the program was killed by the OOM killer due to exceeding its memory limit.
+	memoryExceeded
 )
 
 // An execResult describes the EvalResult of a single execution.
@@ -22,8 +33,12 @@ type execResult struct {
 	Signal int
 	// The Time the execution used.
 	TimeUsageMs int64
-	// The memory the execution used.
-	MemoryUsageKb int
+	// The wall-clock time the execution used.
+	WallTimeUsageMs int64
+	// The peak memory the execution used.
+	MemoryUsageKb int64
+	// Whether the program failed to create a process or thread because of the pid limit.
+	PidLimitReached bool
 }
 
 // CrashedWith checks whether the program exited normally with the given code.
@@ -36,7 +51,49 @@ func (res execResult) Crashed() bool {
 	return (res.ExitType == exited && res.ExitCode != 0) || res.ExitType == signaled
 }
 
-// TimedOut checks whether the program exceeded its Time limit or not.
+// OutputExceeded checks whether the program was killed for exceeding its output file size limit.
+func (res execResult) OutputExceeded() bool {
+	return res.ExitType == signaled && res.Signal == int(syscall.SIGXFSZ)
+}
+
+// TimedOut checks whether the program was killed for exceeding its CPU or wall-clock time limit.
 func (res execResult) TimedOut() bool {
-	return res.ExitType == timedOut
+	return res.ExitType == timedOut || res.ExitType == wallTimedOut
+}
+
+// MemoryExceeded checks whether the program was killed for exceeding its memory limit.
+func (res execResult) MemoryExceeded() bool {
+	return res.ExitType == memoryExceeded
+}
+
+// killReason returns why the sandbox killed the program, if it did.
+func (res execResult) killReason() apipb.KillReason {
+	switch res.ExitType {
+	case timedOut:
+		return apipb.KillReason_KILLED_CPU_TIME
+	case wallTimedOut:
+		return apipb.KillReason_KILLED_WALL_TIME
+	case memoryExceeded:
+		return apipb.KillReason_KILLED_MEMORY
+	default:
+		return apipb.KillReason_KILL_REASON_UNSPECIFIED
+	}
+}
+
+// description describes how the program exited, for use in error messages.
+func (res execResult) description() string {
+	switch res.ExitType {
+	case exited:
+		return fmt.Sprintf("exited with code %d", res.ExitCode)
+	case signaled:
+		return fmt.Sprintf("was killed by signal %d", res.Signal)
+	case timedOut:
+		return "timed out"
+	case wallTimedOut:
+		return "exceeded its wall-clock time limit"
+	case memoryExceeded:
+		return "exceeded its memory limit"
+	default:
+		return "exited in an unknown way"
+	}
 }
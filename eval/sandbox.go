@@ -2,15 +2,36 @@ package eval
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/google/logger"
 	"io"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
+var (
+	// ErrSandboxProtocol is wrapped by the errors returned when the sandbox process writes output that can not be
+	// parsed.
+	ErrSandboxProtocol = errors.New("unexpected output from sandbox")
+	// ErrSandboxDied is wrapped by the errors returned when the sandbox process exits or fails to set up its container
+	// while running a command.
+	ErrSandboxDied = errors.New("sandbox died")
+	// ErrInvalidCommand is wrapped by the errors returned when a command can not be passed to the sandbox.
+	ErrInvalidCommand = errors.New("invalid sandbox command")
+	// ErrIncompatibleSandbox is wrapped by the errors returned when the sandbox binary does not speak the protocol
+	// version expected by this package, typically because one of them is outdated.
+	ErrIncompatibleSandbox = errors.New("incompatible sandbox binary")
+)
+
+// handshakeTimeout is how long to wait for a started sandbox to announce its protocol version.
+const handshakeTimeout = 10 * time.Second
+
 type sandboxArgs struct {
 	WorkingDirectory  string
 	InputPath         string
@@ -21,24 +42,38 @@ type sandboxArgs struct {
 	SkipDefaultMounts bool
 	TimeLimitMs       int
 	MemoryLimitKb     int
+	OutputLimitKb     int
 	Pids              int
 	Env               map[string]string
 }
 
 type sandboxWrapper struct {
+	args       sandboxArgs
+	id         int
+	ctx        context.Context
 	cmd        *exec.Cmd
 	sandboxIn  io.WriteCloser
-	sandboxOut *bufio.Scanner
+	sandboxOut *bufio.Reader
 	sandboxErr strings.Builder
-	waited     bool
+	// Whether the sandbox holds a sandbox ID.
+	started bool
+	// Whether the current sandbox process has been reaped.
+	waited bool
 }
 
-func newSandbox(id int, args sandboxArgs) *sandboxWrapper {
+// newSandbox returns a sandbox with the given arguments. It is not assigned a sandbox ID until it is started.
+func newSandbox(args sandboxArgs) *sandboxWrapper {
+	return &sandboxWrapper{
+		args: args,
+	}
+}
+
+func (args sandboxArgs) commandLine(id int) []string {
 	sandboxArgs := []string{
 		"--sandbox-id", strconv.Itoa(id),
 		"--time-lim-ms", strconv.Itoa(args.TimeLimitMs),
-		"--wall-time-lim-ms", strconv.Itoa(args.TimeLimitMs*2 + 1000),
-		"--memory-mb", strconv.Itoa(args.MemoryLimitKb),
+		"--wall-time-lim-ms", strconv.Itoa(wallTimeLimitMs(args.TimeLimitMs)),
+		"--memory-mb", strconv.Itoa((args.MemoryLimitKb + 1023) / 1024),
 		"--inodes", "1000",
 		"--blocks", strconv.Itoa(1_000_000_000 / 4096),
 	}
@@ -48,6 +83,9 @@ func newSandbox(id int, args sandboxArgs) *sandboxWrapper {
 		args.Pids = 30
 	}
 	sandboxArgs = append(sandboxArgs, "--pid-limit", strconv.Itoa(args.Pids))
+	if args.OutputLimitKb != 0 {
+		sandboxArgs = append(sandboxArgs, "--file-size-limit-kb", strconv.Itoa(args.OutputLimitKb))
+	}
 	if args.WorkingDirectory != "" {
 		sandboxArgs = append(sandboxArgs, "--working-dir", args.WorkingDirectory)
 	}
@@ -73,116 +111,289 @@ func newSandbox(id int, args sandboxArgs) *sandboxWrapper {
 		sandboxArgs = append(sandboxArgs, "--env", fmt.Sprintf("%s=%s", key, value))
 	}
 	sandboxArgs = append(sandboxArgs, mountArgs(readPaths, writePaths)...)
-	logger.Infof("Sandbox %d running with args %v", id, sandboxArgs)
-	cmd := exec.Command("/usr/bin/omogenexec", sandboxArgs...)
-	sandbox := &sandboxWrapper{
-		cmd: cmd,
+	return sandboxArgs
+}
+
+// wallTimeLimitMs returns the wall-clock time limit of a command with the given CPU time limit. It is generous, so
+// that programs slowed down by other load on the host are not killed.
+func wallTimeLimitMs(timeLimitMs int) int {
+	return timeLimitMs*2 + 1000
+}
+
+// Start leases a sandbox ID and starts the sandbox process. If all IDs are in use, it either waits for one to be
+// released or fails with ErrSandboxesExhausted, depending on how sandboxes are configured.
+//
+// If the context is cancelled, the sandbox process is killed, and any command running in it fails with an error
+// wrapping ErrCancelled.
+func (s *sandboxWrapper) Start(ctx context.Context) error {
+	id, err := sandboxIds.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	if err := s.start(ctx, id); err != nil {
+		s.started = false
+		sandboxIds.release(id)
+		return err
 	}
+	return nil
+}
+
+func (s *sandboxWrapper) start(ctx context.Context, id int) error {
+	sandboxArgs := s.args.commandLine(id)
+	logger.Infof("Sandbox %d running with args %v", id, sandboxArgs)
+	cmd := exec.CommandContext(ctx, "/usr/bin/omogenexec", sandboxArgs...)
 	inPipe, err := cmd.StdinPipe()
 	if err != nil {
-		return nil
+		return fmt.Errorf("failed creating sandbox stdin: %v", err)
 	}
-	sandbox.sandboxIn = inPipe
 	outPipe, err := cmd.StdoutPipe()
 	if err != nil {
+		return fmt.Errorf("failed creating sandbox stdout: %v", err)
+	}
+	s.sandboxOut = bufio.NewReader(outPipe)
+	cmd.Stderr = &s.sandboxErr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	s.id = id
+	s.ctx = ctx
+	s.cmd = cmd
+	s.sandboxIn = inPipe
+	s.started = true
+	s.waited = false
+	return s.handshake()
+}
+
+// handshake waits for the sandbox process to announce its protocol version, failing with an error wrapping
+// ErrIncompatibleSandbox if it does not match ours.
+func (s *sandboxWrapper) handshake() error {
+	type reply struct {
+		msg *sandboxMessage
+		err error
+	}
+	replies := make(chan reply, 1)
+	go func() {
+		msg, err := readMessage(s.sandboxOut)
+		replies <- reply{msg, err}
+	}()
+	select {
+	case <-s.ctx.Done():
+		s.stop(true)
+		return cancelled(s.ctx)
+	case <-time.After(handshakeTimeout):
+		return s.fail(ErrIncompatibleSandbox, "no handshake within %v; is /usr/bin/omogenexec outdated?", handshakeTimeout)
+	case r := <-replies:
+		if r.err == io.EOF || r.err == io.ErrUnexpectedEOF {
+			return s.fail(ErrSandboxDied, "exited during setup")
+		}
+		if r.err != nil {
+			return s.fail(ErrIncompatibleSandbox, "invalid handshake: %v; is /usr/bin/omogenexec outdated?", r.err)
+		}
+		version, _ := r.msg.get("protocol")
+		if version != strconv.Itoa(sandboxProtocolVersion) {
+			return s.fail(ErrIncompatibleSandbox, "sandbox speaks protocol version %q, expected %d",
+				version, sandboxProtocolVersion)
+		}
 		return nil
 	}
-	sandbox.sandboxOut = bufio.NewScanner(bufio.NewReader(outPipe))
-	sandbox.sandboxOut.Split(bufio.ScanWords)
-	cmd.Stderr = &sandbox.sandboxErr
-	return sandbox
 }
 
-func (s *sandboxWrapper) Start() error {
-	return s.cmd.Start()
+// restart replaces the sandbox process with a new one, keeping its sandbox ID. It is used to recover after the sandbox
+// failed.
+func (s *sandboxWrapper) restart() error {
+	if !s.started {
+		return fmt.Errorf("%w: restarting a sandbox that was never started", ErrSandboxDied)
+	}
+	s.stop(true)
+	s.sandboxErr.Reset()
+	return s.start(s.ctx, s.id)
+}
+
+// fail kills the sandbox process after it failed, so that it can not be used for further commands, and returns an
+// error wrapping the reason.
+func (s *sandboxWrapper) fail(reason error, format string, a ...interface{}) error {
+	s.stop(true)
+	return fmt.Errorf("%w: %s (logs: %s)", reason, fmt.Sprintf(format, a...), s.logs())
 }
 
+// runOptions configures a single command run in a sandbox.
+type runOptions struct {
+	// Limits that replace those the sandbox was started with, if non-zero. If only the time limit is set, the
+	// wall-clock time limit is derived from it.
+	TimeLimitMs     int
+	WallTimeLimitMs int
+	MemoryLimitKb   int
+	OutputLimitKb   int
+	// Environment variables that are added to or replace those the sandbox was started with.
+	Env map[string]string
+}
+
+func (opts runOptions) command(cmdAndArgs []string) *sandboxMessage {
+	msg := &sandboxMessage{}
+	for _, arg := range cmdAndArgs {
+		msg.add("arg", arg)
+	}
+	var keys []string
+	for key := range opts.Env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		msg.add("env", fmt.Sprintf("%s=%s", key, opts.Env[key]))
+	}
+	if opts.TimeLimitMs != 0 {
+		msg.addInt("time_limit_ms", int64(opts.TimeLimitMs))
+	}
+	if opts.WallTimeLimitMs != 0 {
+		msg.addInt("wall_time_limit_ms", int64(opts.WallTimeLimitMs))
+	} else if opts.TimeLimitMs != 0 {
+		msg.addInt("wall_time_limit_ms", int64(wallTimeLimitMs(opts.TimeLimitMs)))
+	}
+	if opts.MemoryLimitKb != 0 {
+		msg.addInt("memory_limit_bytes", int64(opts.MemoryLimitKb)*1024)
+	}
+	if opts.OutputLimitKb != 0 {
+		msg.addInt("file_size_limit_bytes", int64(opts.OutputLimitKb)*1024)
+	}
+	return msg
+}
+
+// Run executes a command in the sandbox, using the limits the sandbox was started with.
 func (s *sandboxWrapper) Run(cmdAndArgs []string) (*execResult, error) {
+	return s.RunWith(cmdAndArgs, runOptions{})
+}
+
+// RunWith executes a command in the sandbox with the given options. If the sandbox process fails, an error wrapping
+// ErrSandboxDied or ErrSandboxProtocol is returned, and the sandbox must be restarted before it can be used again.
+// Commands that can not be passed to the sandbox, such as those too large for the protocol, instead fail with an error
+// wrapping ErrInvalidCommand and leave the sandbox running.
+func (s *sandboxWrapper) RunWith(cmdAndArgs []string, opts runOptions) (*execResult, error) {
 	logger.Infof("Sandbox executing command %v", cmdAndArgs)
-	// Binary format is [#of commands + args] command [0x0] arg [0x0] arg ... [0x0]
-	fields := len(cmdAndArgs)
-	if fields > 255 {
-		logger.Fatal("Too many args to sandbox (%v)", cmdAndArgs)
+	if !s.started || s.waited {
+		return nil, fmt.Errorf("%w: sandbox is not running", ErrSandboxDied)
 	}
-	if fields == 0 {
-		logger.Fatal("Too few args to sandbox (%v)", cmdAndArgs)
+	if len(cmdAndArgs) == 0 {
+		return nil, fmt.Errorf("%w: no command", ErrInvalidCommand)
 	}
-	msg := []byte{byte(fields)}
-	for _, arg := range cmdAndArgs {
-		msg = append(msg, []byte(arg)...)
-		msg = append(msg, 0x0)
+	if err := writeMessage(s.sandboxIn, opts.command(cmdAndArgs)); err != nil {
+		// Nothing was written, so the sandbox can still run other commands.
+		if errors.Is(err, errMessageTooLarge) {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidCommand, err)
+		}
+		if s.ctx.Err() != nil {
+			s.stop(true)
+			return nil, cancelled(s.ctx)
+		}
+		return nil, s.fail(ErrSandboxDied, "failed writing command: %v", err)
 	}
-	// Pipes internally write all the data at once, so no need for retries here
-	if _, err := s.sandboxIn.Write(msg); err != nil {
-		logger.Infof("Failed writing to the sandbox: %v", err)
+	msg, err := readMessage(s.sandboxOut)
+	if err != nil {
+		if s.ctx.Err() != nil {
+			s.stop(true)
+			return nil, cancelled(s.ctx)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, s.fail(ErrSandboxDied, "output ended unexpectedly")
+		}
+		return nil, s.fail(ErrSandboxProtocol, "failed reading result: %v", err)
 	}
+	res, err := s.parseResult(msg)
+	if err != nil {
+		return nil, err
+	}
+	logger.Infof("Sandbox run complete")
+	return res, nil
+}
+
+func (s *sandboxWrapper) parseResult(msg *sandboxMessage) (*execResult, error) {
 	res := &execResult{}
-	for {
-		tok := s.sandboxToken()
-		if tok == "done" {
-			break
-		} else if tok == "killed" {
-			killReason := s.sandboxToken()
-			if killReason == "tle" {
-				res.ExitType = timedOut
-			} else if killReason == "setup" {
-				s.Finish()
-				return res, fmt.Errorf("sandbox died during setup: %v", s.logs())
-			} else {
-				logger.Fatalf("Unrecognized output from sandbox (killed %s)", killReason)
-			}
-		} else if tok == "code" {
-			res.ExitType = exited
-			codeStr := s.sandboxToken()
-			exitCode, err := strconv.Atoi(codeStr)
-			if err != nil {
-				logger.Fatalf("Unrecognized output from sandbox (code %s)", codeStr)
-			}
-			res.ExitCode = exitCode
-		} else if tok == "signal" {
-			res.ExitType = signaled
-			signalStr := s.sandboxToken()
-			signal, err := strconv.Atoi(signalStr)
-			if err != nil {
-				logger.Fatalf("Unrecognized output from sandbox (signal %s)", signalStr)
-			}
-			res.Signal = signal
-		} else if tok == "mem" {
-			memStr := s.sandboxToken()
-			mem, err := strconv.Atoi(memStr)
-			if err != nil {
-				logger.Fatalf("Unrecognized output from sandbox (mem %s)", memStr)
-			}
-			res.MemoryUsageKb = mem / 1000
-		} else if tok == "cpu" {
-			cpuStr := s.sandboxToken()
-			cpu, err := strconv.ParseInt(cpuStr, 10, 64)
-			if err != nil {
-				logger.Fatalf("Unrecognized output from sandbox (cpu %s)", cpuStr)
-			}
-			res.TimeUsageMs = cpu
+	status, _ := msg.get("status")
+	switch status {
+	case "exited":
+		res.ExitType = exited
+		code, err := msg.getInt("code")
+		if err != nil {
+			return nil, s.fail(ErrSandboxProtocol, "%v", err)
+		}
+		res.ExitCode = int(code)
+	case "signaled":
+		res.ExitType = signaled
+		signal, err := msg.getInt("signal")
+		if err != nil {
+			return nil, s.fail(ErrSandboxProtocol, "%v", err)
 		}
+		res.Signal = int(signal)
+	case "setup_failed":
+		return nil, s.fail(ErrSandboxDied, "killed during setup")
+	case "invalid_command":
+		// The sandbox rejected the command without running it, so it can still be used.
+		reason, _ := msg.get("error")
+		return nil, fmt.Errorf("%w: %s", ErrInvalidCommand, reason)
+	default:
+		return nil, s.fail(ErrSandboxProtocol, "unknown status %q", status)
 	}
-	logger.Infof("Sandbox run complete")
+	if killed, found := msg.get("killed"); found {
+		switch killed {
+		case "tle":
+			res.ExitType = timedOut
+		case "wall":
+			res.ExitType = wallTimedOut
+		case "mle":
+			res.ExitType = memoryExceeded
+		default:
+			return nil, s.fail(ErrSandboxProtocol, "killed %s", killed)
+		}
+	}
+	cpu, err := msg.getInt("cpu_ms")
+	if err != nil {
+		return nil, s.fail(ErrSandboxProtocol, "%v", err)
+	}
+	res.TimeUsageMs = cpu
+	wall, err := msg.getInt("wall_ms")
+	if err != nil {
+		return nil, s.fail(ErrSandboxProtocol, "%v", err)
+	}
+	res.WallTimeUsageMs = wall
+	mem, err := msg.getInt("mem_bytes")
+	if err != nil {
+		return nil, s.fail(ErrSandboxProtocol, "%v", err)
+	}
+	// Bytes -> KB
+	res.MemoryUsageKb = mem / 1024
+	pidLimitHits, err := msg.getInt("pid_limit_hits")
+	if err != nil {
+		return nil, s.fail(ErrSandboxProtocol, "%v", err)
+	}
+	res.PidLimitReached = pidLimitHits > 0
 	return res, nil
 }
 
-func (s *sandboxWrapper) sandboxToken() string {
-	if !s.sandboxOut.Scan() {
-		s.Finish()
-		logger.Fatalf("Failed reading to the sandbox: %v", s.sandboxErr.String())
+// stop waits for the sandbox process to exit, first killing it if requested.
+func (s *sandboxWrapper) stop(kill bool) {
+	if !s.started || s.waited {
+		return
+	}
+	s.waited = true
+	if kill {
+		// The process may already have exited, in which case there is nothing to kill.
+		_ = s.cmd.Process.Kill()
+	}
+	if err := s.sandboxIn.Close(); err != nil {
+		logger.Warningf("failed closing sandbox input: %v", err)
+	}
+	if err := s.cmd.Wait(); err != nil && !kill {
+		logger.Warningf("sandbox exited with error: %v", err)
 	}
-	return s.sandboxOut.Text()
 }
 
+// Finish stops the sandbox process and releases its sandbox ID.
 func (s *sandboxWrapper) Finish() {
-	if !s.waited {
-		s.waited = true
-		if err := s.sandboxIn.Close(); err != nil {
-			panic(err)
-		}
-		s.cmd.Wait()
+	if !s.started {
+		return
 	}
+	s.stop(false)
+	s.started = false
+	sandboxIds.release(s.id)
 }
 
 func (s *sandboxWrapper) logs() string {
@@ -0,0 +1,46 @@
+package eval
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestRunOversizedCommand(t *testing.T) {
+	// cat stands in for the sandbox process, which must not be killed by a command that was never sent to it.
+	cmd := exec.Command("cat")
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	s := &sandboxWrapper{ctx: context.Background(), cmd: cmd, sandboxIn: in, sandboxOut: bufio.NewReader(out), started: true}
+	defer s.stop(true)
+
+	_, err = s.RunWith([]string{"/bin/true"}, runOptions{Env: map[string]string{"X": strings.Repeat("x", maxMessageBytes)}})
+	if !errors.Is(err, ErrInvalidCommand) {
+		t.Errorf("Run of oversized command = %v; want ErrInvalidCommand", err)
+	}
+	if sandboxFailed(err) {
+		t.Errorf("Run of oversized command failed the sandbox: %v", err)
+	}
+	if s.waited {
+		t.Errorf("Run of oversized command stopped the sandbox")
+	}
+	// The sandbox process must still be reading commands.
+	if err := writeMessage(s.sandboxIn, runOptions{}.command([]string{"/bin/true"})); err != nil {
+		t.Errorf("writing command after oversized command: %v", err)
+	}
+	if _, err := readMessage(s.sandboxOut); err != nil {
+		t.Errorf("reading from sandbox after oversized command: %v", err)
+	}
+}
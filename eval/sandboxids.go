@@ -0,0 +1,75 @@
+package eval
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// maxSandboxes is the number of sandbox containers supported by the sandbox (its MAX_CONTAINERS).
+const maxSandboxes = 100
+
+// ErrSandboxesExhausted is returned when starting a sandbox while all sandbox IDs are in use, unless sandboxes are
+// configured to wait for an ID to be released.
+var ErrSandboxesExhausted = errors.New("all sandbox ids are in use")
+
+// An idAllocator leases sandbox IDs, so that no two sandboxes in the process use the same container concurrently.
+type idAllocator struct {
+	ids   chan int
+	block bool
+	// groupMu is held while leasing a set of IDs that are needed at the same time. Without it, two callers that
+	// each hold some IDs while waiting for more could deadlock.
+	groupMu sync.Mutex
+}
+
+func newIdAllocator(size int, block bool) *idAllocator {
+	alloc := &idAllocator{
+		ids:   make(chan int, size),
+		block: block,
+	}
+	for id := 0; id < size; id++ {
+		alloc.ids <- id
+	}
+	return alloc
+}
+
+var sandboxIds = newIdAllocator(maxSandboxes, true)
+
+// ConfigureSandboxes sets how many sandboxes may run concurrently in this process, and whether starting a sandbox
+// when all of them are in use should wait for one to finish or fail with ErrSandboxesExhausted. By default, all
+// sandbox IDs are used and starting a sandbox waits.
+//
+// It must be called before any sandbox is started.
+func ConfigureSandboxes(maxConcurrent int, block bool) error {
+	if maxConcurrent < 1 || maxConcurrent > maxSandboxes {
+		return fmt.Errorf("number of sandboxes must be between 1 and %d, was %d", maxSandboxes, maxConcurrent)
+	}
+	sandboxIds = newIdAllocator(maxConcurrent, block)
+	return nil
+}
+
+func (a *idAllocator) size() int {
+	return cap(a.ids)
+}
+
+func (a *idAllocator) acquire(ctx context.Context) (int, error) {
+	if !a.block {
+		select {
+		case id := <-a.ids:
+			return id, nil
+		default:
+			return 0, ErrSandboxesExhausted
+		}
+	}
+	select {
+	case id := <-a.ids:
+		return id, nil
+	case <-ctx.Done():
+		return 0, cancelled(ctx)
+	}
+}
+
+func (a *idAllocator) release(id int) {
+	a.ids <- id
+}
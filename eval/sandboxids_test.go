@@ -0,0 +1,62 @@
+package eval
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestIdAllocatorNonBlocking(t *testing.T) {
+	alloc := newIdAllocator(2, false)
+	first, err := alloc.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("failed acquiring first id: %v", err)
+	}
+	second, err := alloc.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("failed acquiring second id: %v", err)
+	}
+	if first == second {
+		t.Errorf("same id %d leased twice", first)
+	}
+	if _, err := alloc.acquire(context.Background()); err != ErrSandboxesExhausted {
+		t.Errorf("expected exhaustion, got %v", err)
+	}
+	alloc.release(first)
+	id, err := alloc.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("failed acquiring released id: %v", err)
+	}
+	if id != first {
+		t.Errorf("expected released id %d, got %d", first, id)
+	}
+}
+
+func TestIdAllocatorBlocking(t *testing.T) {
+	alloc := newIdAllocator(1, true)
+	id, err := alloc.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("failed acquiring id: %v", err)
+	}
+	acquired := make(chan int)
+	go func() {
+		next, _ := alloc.acquire(context.Background())
+		acquired <- next
+	}()
+	alloc.release(id)
+	if next := <-acquired; next != id {
+		t.Errorf("expected id %d after release, got %d", id, next)
+	}
+}
+
+func TestIdAllocatorCancelled(t *testing.T) {
+	alloc := newIdAllocator(1, true)
+	if _, err := alloc.acquire(context.Background()); err != nil {
+		t.Fatalf("failed acquiring id: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := alloc.acquire(ctx); !errors.Is(err, ErrCancelled) {
+		t.Errorf("expected cancellation, got %v", err)
+	}
+}
@@ -0,0 +1,59 @@
+package eval
+
+import (
+	"fmt"
+	apipb "github.com/jsannemo/omogenexec/api"
+	"math"
+)
+
+// checkScore validates a score of a group or of one of its test cases against the score range of the group. Depending
+// on the plan, scores outside the range are either clamped or rejected with a judge error. The score is then rounded.
+func (e *Evaluator) checkScore(score float64, tg *apipb.TestGroup) (float64, error) {
+	if math.IsNaN(score) || math.IsInf(score, 0) {
+		return 0, &judgeError{msg: fmt.Sprintf("score %v is not a finite number", score)}
+	}
+	if r := tg.ScoreRange; r != nil && (score < r.Min || score > r.Max) {
+		if e.plan.ScoreRangePolicy != apipb.ScoreRangePolicy_CLAMP_SCORES {
+			return 0, &judgeError{msg: fmt.Sprintf("score %v is outside of the range [%v, %v]", score, r.Min, r.Max)}
+		}
+		score = math.Max(r.Min, math.Min(r.Max, score))
+	}
+	return e.roundScore(score), nil
+}
+
+// checkCaseScore applies checkScore to the result of a test case, giving it a judge error if the score is rejected.
+func (e *Evaluator) checkCaseScore(res *apipb.Result, tg *apipb.TestGroup) {
+	if res.Verdict == apipb.Verdict_JUDGE_ERROR {
+		return
+	}
+	score, err := e.checkScore(res.Score, tg)
+	if err != nil {
+		setJudgeError(res, &judgeError{msg: err.Error(), feedback: res.Feedback})
+		return
+	}
+	res.Score = score
+}
+
+// maxScoreDecimals is the largest number of decimals scores may be rounded to. A float64 holds about 15 significant
+// decimal digits, and scaling by larger powers of ten soon overflows.
+const maxScoreDecimals = 15
+
+// checkScoreRounding verifies that the score rounding of a plan, if any, is valid.
+func checkScoreRounding(plan *apipb.EvaluationPlan) error {
+	if plan.ScoreRounding == nil {
+		return nil
+	}
+	if d := plan.ScoreRounding.Decimals; d < 0 || d > maxScoreDecimals {
+		return fmt.Errorf("scores can be rounded to between 0 and %d decimals, not %d", maxScoreDecimals, d)
+	}
+	return nil
+}
+
+// roundScore rounds a score to the number of decimals of the plan, if any.
+func (e *Evaluator) roundScore(score float64) float64 {
+	if e.plan.ScoreRounding == nil {
+		return score
+	}
+	scale := math.Pow(10, float64(e.plan.ScoreRounding.Decimals))
+	return math.Round(score*scale) / scale
+}
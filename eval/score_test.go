@@ -0,0 +1,66 @@
+package eval
+
+import (
+	apipb "github.com/jsannemo/omogenexec/api"
+	"math"
+	"testing"
+)
+
+func TestCheckScore(t *testing.T) {
+	tg := &apipb.TestGroup{ScoreRange: &apipb.ScoreRange{Min: 0, Max: 30}}
+	reject := &Evaluator{plan: &apipb.EvaluationPlan{}}
+	clamp := &Evaluator{plan: &apipb.EvaluationPlan{
+		ScoreRangePolicy: apipb.ScoreRangePolicy_CLAMP_SCORES,
+		ScoreRounding:    &apipb.ScoreRounding{Decimals: 2},
+	}}
+
+	if score, err := reject.checkScore(12.3456, tg); err != nil || score != 12.3456 {
+		t.Errorf("checkScore in range = %v, %v; want 12.3456", score, err)
+	}
+	if _, err := reject.checkScore(31, tg); err == nil {
+		t.Errorf("checkScore accepted a score above the range")
+	}
+	if score, err := clamp.checkScore(31, tg); err != nil || score != 30 {
+		t.Errorf("checkScore above range = %v, %v; want 30", score, err)
+	}
+	if score, err := clamp.checkScore(-1, tg); err != nil || score != 0 {
+		t.Errorf("checkScore below range = %v, %v; want 0", score, err)
+	}
+	if score, err := clamp.checkScore(12.3456, tg); err != nil || score != 12.35 {
+		t.Errorf("checkScore with rounding = %v, %v; want 12.35", score, err)
+	}
+	for _, score := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+		if _, err := clamp.checkScore(score, &apipb.TestGroup{}); err == nil {
+			t.Errorf("checkScore accepted %v", score)
+		}
+	}
+}
+
+func TestCheckCaseScore(t *testing.T) {
+	e := &Evaluator{plan: &apipb.EvaluationPlan{}}
+	tg := &apipb.TestGroup{RejectScore: 0, ScoreRange: &apipb.ScoreRange{Min: 0, Max: 1}}
+	res := &apipb.Result{Verdict: apipb.Verdict_ACCEPTED, Score: 2}
+	e.checkCaseScore(res, tg)
+	if res.Verdict != apipb.Verdict_JUDGE_ERROR || res.Score != 0 {
+		t.Errorf("out of range score gave %v", res)
+	}
+}
+
+func TestCheckScoreRounding(t *testing.T) {
+	for _, decimals := range []int32{0, 2, maxScoreDecimals} {
+		plan := &apipb.EvaluationPlan{ScoreRounding: &apipb.ScoreRounding{Decimals: decimals}}
+		if err := checkScoreRounding(plan); err != nil {
+			t.Errorf("%d decimals rejected: %v", decimals, err)
+		}
+		e := &Evaluator{plan: plan}
+		if score := e.roundScore(1.0 / 3); math.IsNaN(score) || math.Abs(score-1.0/3) > 0.5 {
+			t.Errorf("rounding to %d decimals gave %v", decimals, score)
+		}
+	}
+	for _, decimals := range []int32{-1, maxScoreDecimals + 1, 400} {
+		plan := &apipb.EvaluationPlan{ScoreRounding: &apipb.ScoreRounding{Decimals: decimals}}
+		if err := checkScoreRounding(plan); err == nil {
+			t.Errorf("%d decimals accepted", decimals)
+		}
+	}
+}
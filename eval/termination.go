@@ -0,0 +1,91 @@
+package eval
+
+import (
+	apipb "github.com/jsannemo/omogenexec/api"
+	"math"
+)
+
+// groupDetermined returns whether the results of the test cases evaluated so far in a group determine the result of
+// the group, so that the plan lets the group stop evaluating further test cases.
+func (e *Evaluator) groupDetermined(results []*apipb.Result, tg *apipb.TestGroup) bool {
+	mode := e.plan.EarlyTermination
+	if mode != apipb.EarlyTermination_STOP_WHEN_RESULT_DETERMINED && mode != apipb.EarlyTermination_STOP_WHEN_VERDICT_DETERMINED {
+		return false
+	}
+	// The results of subgroups are not bounded by the scores of the group, and a custom grader may do anything with
+	// the results.
+	if tg.CustomGrading || len(tg.Groups) > 0 {
+		return false
+	}
+	// A judge error gives the group a judge error with the score 0 whatever the other results are, and the judge error
+	// policy rather than the early termination decides whether evaluation goes on, so judge errors are left out.
+	var graded []*apipb.Result
+	for _, res := range results {
+		if res.Verdict != apipb.Verdict_JUDGE_ERROR {
+			graded = append(graded, res)
+		}
+	}
+	results = graded
+	if len(results) == 0 {
+		return false
+	}
+	if !verdictDetermined(results, tg) {
+		return false
+	}
+	return mode == apipb.EarlyTermination_STOP_WHEN_VERDICT_DETERMINED || e.scoreDetermined(results, tg)
+}
+
+// verdictDetermined returns whether no further results can change the verdict the default grader gives a group.
+func verdictDetermined(results []*apipb.Result, tg *apipb.TestGroup) bool {
+	anyAccepted, anyFailed, worst := false, false, apipb.Verdict_ACCEPTED
+	for _, res := range results {
+		if res.Verdict == apipb.Verdict_ACCEPTED {
+			anyAccepted = true
+		} else {
+			anyFailed = true
+			if worseness(res.Verdict) > worseness(worst) {
+				worst = res.Verdict
+			}
+		}
+	}
+	switch {
+	case tg.VerdictMode == apipb.VerdictMode_ALWAYS_ACCEPT:
+		return true
+	case tg.AcceptIfAnyAccepted:
+		return anyAccepted
+	case tg.VerdictMode == apipb.VerdictMode_FIRST_ERROR:
+		return anyFailed
+	case tg.VerdictMode == apipb.VerdictMode_WORST_ERROR:
+		// No program verdict is worse than WRONG_ANSWER. A later JUDGE_ERROR would be, but it replaces the verdict of the
+		// group regardless of its verdict mode, so stopping early only risks not finding one, as in any other mode.
+		return worseness(worst) >= worseness(apipb.Verdict_WRONG_ANSWER)
+	default:
+		return false
+	}
+}
+
+// scoreDetermined returns whether no further results can change the score the default grader gives a group. Without
+// a scoring validator, every test case gets either the accept or the reject score of the group, so a MIN or MAX score
+// is determined once it reaches the lower or upper of them.
+func (e *Evaluator) scoreDetermined(results []*apipb.Result, tg *apipb.TestGroup) bool {
+	if e.plan.ScoringValidator {
+		return false
+	}
+	switch tg.ScoringMode {
+	case apipb.ScoringMode_MIN:
+		bound := math.Min(tg.AcceptScore, tg.RejectScore)
+		for _, res := range results {
+			if res.Score <= bound {
+				return true
+			}
+		}
+	case apipb.ScoringMode_MAX:
+		bound := math.Max(tg.AcceptScore, tg.RejectScore)
+		for _, res := range results {
+			if res.Score >= bound {
+				return true
+			}
+		}
+	}
+	return false
+}
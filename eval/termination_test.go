@@ -0,0 +1,47 @@
+package eval
+
+import (
+	apipb "github.com/jsannemo/omogenexec/api"
+	"testing"
+)
+
+func TestGroupDetermined(t *testing.T) {
+	ac := &apipb.Result{Verdict: apipb.Verdict_ACCEPTED, Score: 10}
+	wa := &apipb.Result{Verdict: apipb.Verdict_WRONG_ANSWER, Score: 0}
+	tle := &apipb.Result{Verdict: apipb.Verdict_TIME_LIMIT_EXCEEDED, Score: 0}
+	je := &apipb.Result{Verdict: apipb.Verdict_JUDGE_ERROR, Score: 0}
+	minGroup := &apipb.TestGroup{AcceptScore: 10, ScoringMode: apipb.ScoringMode_MIN, VerdictMode: apipb.VerdictMode_FIRST_ERROR}
+	sumGroup := &apipb.TestGroup{AcceptScore: 10, ScoringMode: apipb.ScoringMode_SUM, VerdictMode: apipb.VerdictMode_FIRST_ERROR}
+	worstGroup := &apipb.TestGroup{AcceptScore: 10, ScoringMode: apipb.ScoringMode_MIN, VerdictMode: apipb.VerdictMode_WORST_ERROR}
+	anyGroup := &apipb.TestGroup{AcceptScore: 10, ScoringMode: apipb.ScoringMode_MAX, VerdictMode: apipb.VerdictMode_WORST_ERROR, AcceptIfAnyAccepted: true}
+	parentGroup := &apipb.TestGroup{ScoringMode: apipb.ScoringMode_MIN, VerdictMode: apipb.VerdictMode_FIRST_ERROR, Groups: []*apipb.TestGroup{minGroup}}
+
+	tests := []struct {
+		name    string
+		mode    apipb.EarlyTermination
+		scoring bool
+		tg      *apipb.TestGroup
+		results []*apipb.Result
+		want    bool
+	}{
+		{"disabled", apipb.EarlyTermination_EVALUATE_ALL, false, minGroup, []*apipb.Result{wa}, false},
+		{"min after failure", apipb.EarlyTermination_STOP_WHEN_RESULT_DETERMINED, false, minGroup, []*apipb.Result{ac, wa}, true},
+		{"min while accepted", apipb.EarlyTermination_STOP_WHEN_RESULT_DETERMINED, false, minGroup, []*apipb.Result{ac}, false},
+		{"min with scoring validator", apipb.EarlyTermination_STOP_WHEN_RESULT_DETERMINED, true, minGroup, []*apipb.Result{wa}, false},
+		{"sum after failure", apipb.EarlyTermination_STOP_WHEN_RESULT_DETERMINED, false, sumGroup, []*apipb.Result{wa}, false},
+		{"sum verdict after failure", apipb.EarlyTermination_STOP_WHEN_VERDICT_DETERMINED, false, sumGroup, []*apipb.Result{wa}, true},
+		{"worst error after wrong answer", apipb.EarlyTermination_STOP_WHEN_RESULT_DETERMINED, false, worstGroup, []*apipb.Result{ac, wa}, true},
+		{"worst error after time limit", apipb.EarlyTermination_STOP_WHEN_RESULT_DETERMINED, false, worstGroup, []*apipb.Result{tle}, false},
+		{"worst error after time limit and wrong answer", apipb.EarlyTermination_STOP_WHEN_VERDICT_DETERMINED, false, worstGroup, []*apipb.Result{tle, wa}, true},
+		{"accept if any accepted", apipb.EarlyTermination_STOP_WHEN_RESULT_DETERMINED, false, anyGroup, []*apipb.Result{wa, ac}, true},
+		{"judge error", apipb.EarlyTermination_STOP_WHEN_RESULT_DETERMINED, false, minGroup, []*apipb.Result{ac, je}, false},
+		{"judge error and failure", apipb.EarlyTermination_STOP_WHEN_RESULT_DETERMINED, false, minGroup, []*apipb.Result{je, wa}, true},
+		{"with subgroups", apipb.EarlyTermination_STOP_WHEN_RESULT_DETERMINED, false, parentGroup, []*apipb.Result{wa}, false},
+	}
+	for _, tt := range tests {
+		e := &Evaluator{plan: &apipb.EvaluationPlan{EarlyTermination: tt.mode, ScoringValidator: tt.scoring}}
+		if got := e.groupDetermined(tt.results, tt.tg); got != tt.want {
+			t.Errorf("%s: groupDetermined = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
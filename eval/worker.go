@@ -0,0 +1,84 @@
+package eval
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+)
+
+// A worker owns the sandboxes and file system environments used to evaluate a single test case at a time.
+//
+// An Evaluator has one worker per test case it may evaluate concurrently.
+type worker struct {
+	id                       int
+	linker                   *fileLinker
+	valLinker                *fileLinker
+	programSandbox           *sandboxWrapper
+	evalSandbox              *sandboxWrapper
+	validatorCommandTemplate []string
+}
+
+func (e *Evaluator) newWorker(id int) (*worker, error) {
+	w := &worker{id: id}
+	if err := e.initProgram(w); err != nil {
+		return nil, fmt.Errorf("failed initializing program: %v", err)
+	}
+	if err := e.initValidator(w); err != nil {
+		return nil, fmt.Errorf("failed initializing validator: %v", err)
+	}
+	return w, nil
+}
+
+// path returns the path of a directory private to the worker.
+func (w *worker) path(root, name string) string {
+	return filepath.Join(root, fmt.Sprintf("%s-%d", name, w.id))
+}
+
+func (w *worker) start(ctx context.Context) error {
+	if err := w.programSandbox.Start(ctx); err != nil {
+		return fmt.Errorf("failed starting sandbox: %w", err)
+	}
+	if w.evalSandbox != nil {
+		if err := w.evalSandbox.Start(ctx); err != nil {
+			return fmt.Errorf("failed starting sandbox: %w", err)
+		}
+	}
+	return nil
+}
+
+func (w *worker) finish() {
+	w.programSandbox.Finish()
+	if w.evalSandbox != nil {
+		w.evalSandbox.Finish()
+	}
+}
+
+// restart replaces the sandbox processes of the worker after one of them failed, and clears its environments.
+func (w *worker) restart() error {
+	if err := w.programSandbox.restart(); err != nil {
+		return fmt.Errorf("failed restarting sandbox: %w", err)
+	}
+	if w.evalSandbox != nil {
+		if err := w.evalSandbox.restart(); err != nil {
+			return fmt.Errorf("failed restarting sandbox: %w", err)
+		}
+	}
+	return w.clear()
+}
+
+func (w *worker) clear() error {
+	if err := w.linker.Clear(); err != nil {
+		return err
+	}
+	if w.valLinker != nil {
+		return w.valLinker.Clear()
+	}
+	return nil
+}
+
+func (w *worker) validatorCommand(groupFlags []string) []string {
+	var flags []string
+	flags = append(flags, w.validatorCommandTemplate...)
+	flags = append(flags, groupFlags...)
+	return flags
+}
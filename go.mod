@@ -5,4 +5,6 @@ go 1.16
 require (
 	github.com/google/logger v1.1.1
 	google.golang.org/grpc v1.39.0
+	google.golang.org/protobuf v1.25.0
+	gopkg.in/yaml.v2 v2.2.3
 )
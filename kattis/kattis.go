@@ -0,0 +1,224 @@
+// Package kattis loads problem packages in the Kattis problem package format into evaluation plans.
+package kattis
+
+import (
+	"fmt"
+	apipb "github.com/jsannemo/omogenexec/api"
+	"github.com/jsannemo/omogenexec/eval"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+type problemLimits struct {
+	// Limits are in MiB and seconds.
+	Memory           int `yaml:"memory"`
+	Output           int `yaml:"output"`
+	ValidationTime   int `yaml:"validation_time"`
+	ValidationMemory int `yaml:"validation_memory"`
+	ValidationPasses int `yaml:"validation_passes"`
+}
+
+type problemConfig struct {
+	Type           string        `yaml:"type"`
+	Validation     string        `yaml:"validation"`
+	ValidatorFlags string        `yaml:"validator_flags"`
+	Limits         problemLimits `yaml:"limits"`
+}
+
+func defaultProblemConfig() problemConfig {
+	return problemConfig{
+		Type:       "pass-fail",
+		Validation: "default",
+		Limits: problemLimits{
+			Memory:           2048,
+			Output:           8,
+			ValidationTime:   60,
+			ValidationMemory: 2048,
+			ValidationPasses: 2,
+		},
+	}
+}
+
+// Load reads the problem package in the given directory and builds a plan for evaluating submissions to it. The
+// output validator and grader of the package, if any, are compiled into subdirectories of outputPath.
+//
+// The Program of the returned plan must be set before it is evaluated. Its time limit is read from the .timelimit
+// file of the package, if there is one; otherwise the TimeLimitMs of the plan must be set as well.
+func Load(problemPath, outputPath string) (*apipb.EvaluationPlan, error) {
+	config := defaultProblemConfig()
+	if err := readYaml(filepath.Join(problemPath, "problem.yaml"), &config); err != nil {
+		return nil, err
+	}
+	validation := strings.Fields(config.Validation)
+	if len(validation) == 0 || (validation[0] != "default" && validation[0] != "custom") {
+		return nil, fmt.Errorf("invalid validation: %q", config.Validation)
+	}
+	customValidation := validation[0] == "custom"
+	plan := &apipb.EvaluationPlan{
+		PlanType:             apipb.EvaluationType_SIMPLE,
+		MemLimitKb:           int32(config.Limits.Memory * 1024),
+		OutputLimitKb:        int32(config.Limits.Output * 1024),
+		ValidatorTimeLimitMs: int32(config.Limits.ValidationTime * 1000),
+		ValidatorMemLimitKb:  int32(config.Limits.ValidationMemory * 1024),
+	}
+	interactive, multiPass := false, false
+	for _, option := range validation[1:] {
+		switch option {
+		case "interactive":
+			interactive = true
+		case "multi-pass":
+			multiPass = true
+		case "score":
+			plan.ScoringValidator = true
+		default:
+			return nil, fmt.Errorf("invalid validation option: %s", option)
+		}
+	}
+	if multiPass {
+		if !interactive {
+			return nil, fmt.Errorf("multi-pass validation is only supported for interactive problems")
+		}
+		plan.PlanType = apipb.EvaluationType_MULTI_PASS
+		plan.ValidationPasses = int32(config.Limits.ValidationPasses)
+	} else if interactive {
+		plan.PlanType = apipb.EvaluationType_INTERACTIVE
+	}
+	if !customValidation && (interactive || plan.ScoringValidator) {
+		return nil, fmt.Errorf("validation %q requires a custom output validator", config.Validation)
+	}
+	if config.Type != "pass-fail" && config.Type != "scoring" {
+		return nil, fmt.Errorf("invalid problem type: %s", config.Type)
+	}
+	if plan.ScoringValidator && config.Type != "scoring" {
+		return nil, fmt.Errorf("scoring validation requires a scoring problem")
+	}
+
+	timeLimit, err := readTimeLimit(problemPath)
+	if err != nil {
+		return nil, err
+	}
+	plan.TimeLimitMs = timeLimit
+
+	root, usesCustomGrading, err := loadGroups(filepath.Join(problemPath, "data"), strings.Fields(config.ValidatorFlags))
+	if err != nil {
+		return nil, err
+	}
+	plan.RootGroup = root
+
+	if customValidation {
+		validator, err := compileProgram(filepath.Join(problemPath, "output_validators"), filepath.Join(outputPath, "output_validator"))
+		if err != nil {
+			return nil, fmt.Errorf("failed compiling output validator: %v", err)
+		}
+		plan.Validator = validator
+	}
+	if usesCustomGrading {
+		grader, err := compileProgram(filepath.Join(problemPath, "graders"), filepath.Join(outputPath, "grader"))
+		if err != nil {
+			return nil, fmt.Errorf("failed compiling grader: %v", err)
+		}
+		plan.Grader = grader
+	}
+	return plan, nil
+}
+
+// readYaml unmarshals a YAML file into the given value. A missing file leaves the value unchanged.
+func readYaml(path string, out interface{}) error {
+	dat, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := yaml.Unmarshal(dat, out); err != nil {
+		return fmt.Errorf("failed parsing %s: %v", path, err)
+	}
+	return nil
+}
+
+func readTimeLimit(problemPath string) (int32, error) {
+	dat, err := ioutil.ReadFile(filepath.Join(problemPath, ".timelimit"))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	seconds, err := strconv.ParseFloat(strings.TrimSpace(string(dat)), 64)
+	if err != nil || seconds <= 0 {
+		return 0, fmt.Errorf("invalid time limit: %q", string(dat))
+	}
+	return int32(math.Round(seconds * 1000)), nil
+}
+
+var languageExtensions = map[string]apipb.LanguageGroup{
+	".c":    apipb.LanguageGroup_C,
+	".cc":   apipb.LanguageGroup_CPP,
+	".cpp":  apipb.LanguageGroup_CPP,
+	".cs":   apipb.LanguageGroup_CSHARP,
+	".go":   apipb.LanguageGroup_GO,
+	".java": apipb.LanguageGroup_JAVA,
+	".js":   apipb.LanguageGroup_JAVASCRIPT,
+	".py":   apipb.LanguageGroup_PYTHON_3,
+	".rb":   apipb.LanguageGroup_RUBY,
+	".rs":   apipb.LanguageGroup_RUST,
+}
+
+// compileProgram compiles the single program found in the given directory of a package. The program is either a
+// single source file or a directory of source files, whose language is determined by their extensions.
+func compileProgram(dir, outputPath string) (*apipb.CompiledProgram, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) != 1 {
+		return nil, fmt.Errorf("expected a single program in %s, found %d", dir, len(entries))
+	}
+	programPath := filepath.Join(dir, entries[0].Name())
+	program := &apipb.Program{}
+	err = filepath.Walk(programPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		lang, found := languageExtensions[filepath.Ext(path)]
+		if !found {
+			return nil
+		}
+		if program.Language != apipb.LanguageGroup_LANGUAGE_GROUP_UNSPECIFIED && program.Language != lang {
+			return fmt.Errorf("program in %s mixes languages %v and %v", programPath, program.Language, lang)
+		}
+		program.Language = lang
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		relPath := info.Name()
+		if entries[0].IsDir() {
+			if relPath, err = filepath.Rel(programPath, path); err != nil {
+				return err
+			}
+		}
+		program.Sources = append(program.Sources, &apipb.SourceFile{Path: relPath, Contents: contents})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(program.Sources) == 0 {
+		return nil, fmt.Errorf("no source files found in %s", programPath)
+	}
+	compilation, err := eval.Compile(program, outputPath)
+	if err != nil {
+		return nil, err
+	}
+	if compilation.Program == nil {
+		return nil, fmt.Errorf("compilation failed: %s", compilation.CompilerErrors)
+	}
+	return compilation.Program, nil
+}
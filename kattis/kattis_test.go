@@ -0,0 +1,139 @@
+package kattis
+
+import (
+	apipb "github.com/jsannemo/omogenexec/api"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writePackage(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for path, contents := range files {
+		fullPath := filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fullPath, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestLoadScoringProblem(t *testing.T) {
+	dir := writePackage(t, map[string]string{
+		"problem.yaml":                    "name: Test\ntype: scoring\nvalidator_flags: float_tolerance 1e-6\nlimits:\n  memory: 512\n",
+		".timelimit":                      "1.5\n",
+		"data/testdata.yaml":              "on_reject: continue\ngrader_flags: ignore_sample sum\n",
+		"data/sample/1.in":                "",
+		"data/sample/1.ans":               "",
+		"data/secret/testdata.yaml":       "grader_flags: first_error\n",
+		"data/secret/g1/testdata.yaml":    "accept_score: 30\nrange: 0 30\non_reject: break\ngrader_flags: min\n",
+		"data/secret/g1/a.in":             "",
+		"data/secret/g1/a.ans":            "",
+		"data/secret/g2/testdata.yaml":    "accept_score: 70\noutput_validator_flags: case_sensitive\n",
+		"data/secret/g2/b.in":             "",
+		"data/secret/g2/b.ans":            "",
+		"data/secret/g2/nested/c.in":      "",
+		"data/secret/g2/nested/c.ans":     "",
+		"data/secret/g2/not_a_case.txt":   "",
+		"data/secret/g2/nested/extra.ans": "",
+	})
+	plan, err := Load(dir, t.TempDir())
+	if err != nil {
+		t.Fatalf("failed loading problem: %v", err)
+	}
+	if plan.TimeLimitMs != 1500 || plan.MemLimitKb != 512*1024 {
+		t.Errorf("wrong limits: time %d, memory %d", plan.TimeLimitMs, plan.MemLimitKb)
+	}
+	if plan.Validator != nil || plan.Grader != nil {
+		t.Errorf("unexpected validator or grader")
+	}
+
+	root := plan.RootGroup
+	if root.BreakOnFail || !root.IgnoreSample || root.ScoringMode != apipb.ScoringMode_SUM || len(root.Groups) != 2 {
+		t.Fatalf("wrong root group: %v", root)
+	}
+	if sample := root.Groups[0]; !sample.IsSample {
+		t.Errorf("sample group not marked as sample: %v", sample)
+	}
+	secret := root.Groups[1]
+	if secret.IsSample {
+		t.Errorf("secret group marked as sample")
+	}
+	if secret.Name != "secret" || secret.VerdictMode != apipb.VerdictMode_FIRST_ERROR || len(secret.Groups) != 2 {
+		t.Fatalf("wrong secret group: %v", secret)
+	}
+	g1 := secret.Groups[0]
+	if !g1.BreakOnFail || g1.AcceptScore != 30 || g1.ScoringMode != apipb.ScoringMode_MIN || len(g1.Cases) != 1 {
+		t.Errorf("wrong group g1: %v", g1)
+	}
+	if r := g1.ScoreRange; r == nil || r.Min != 0 || r.Max != 30 {
+		t.Errorf("wrong score range of g1: %v", r)
+	}
+	if secret.ScoreRange != nil {
+		t.Errorf("unbounded score range kept: %v", secret.ScoreRange)
+	}
+	g2 := secret.Groups[1]
+	if g2.BreakOnFail || g2.AcceptScore != 70 || len(g2.Cases) != 1 || len(g2.Groups) != 1 {
+		t.Fatalf("wrong group g2: %v", g2)
+	}
+	wantFlags := []string{"float_tolerance", "1e-6", "case_sensitive"}
+	nested := g2.Groups[0]
+	if len(nested.OutputValidatorFlags) != len(wantFlags) || nested.AcceptScore != 70 {
+		t.Fatalf("nested group did not inherit settings: %v", nested)
+	}
+	for i, flag := range wantFlags {
+		if nested.OutputValidatorFlags[i] != flag {
+			t.Errorf("wrong validator flags %v, expected %v", nested.OutputValidatorFlags, wantFlags)
+		}
+	}
+	tc := nested.Cases[0]
+	if tc.Name != "c" || tc.InputPath != filepath.Join(dir, "data/secret/g2/nested/c.in") || tc.OutputPath != filepath.Join(dir, "data/secret/g2/nested/c.ans") {
+		t.Errorf("wrong test case: %v", tc)
+	}
+}
+
+func TestLoadInvalidProblems(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+	}{
+		{"missing answer", map[string]string{"data/secret/1.in": ""}},
+		{"score outside range", map[string]string{"data/testdata.yaml": "accept_score: 5\nrange: 0 1\n"}},
+		{"ignore_sample without samples", map[string]string{"data/testdata.yaml": "grader_flags: ignore_sample\n", "data/secret/1.in": "", "data/secret/1.ans": ""}},
+		{"unknown grader flag", map[string]string{"data/testdata.yaml": "grader_flags: best_error\n"}},
+		{"invalid on_reject", map[string]string{"data/testdata.yaml": "on_reject: retry\n"}},
+		{"interactive without validator", map[string]string{"problem.yaml": "validation: default interactive\n", "data/secret/1.in": "", "data/secret/1.ans": ""}},
+		{"non-interactive multi-pass", map[string]string{"problem.yaml": "validation: custom multi-pass\n", "data/secret/1.in": "", "data/secret/1.ans": ""}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.files[".timelimit"] = "1"
+			dir := writePackage(t, test.files)
+			if _, err := Load(dir, t.TempDir()); err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
+
+func TestLoadInheritedIgnoreSample(t *testing.T) {
+	dir := writePackage(t, map[string]string{
+		".timelimit":         "1",
+		"data/testdata.yaml": "grader_flags: ignore_sample\n",
+		"data/sample/1.in":   "",
+		"data/sample/1.ans":  "",
+		"data/secret/2.in":   "",
+		"data/secret/2.ans":  "",
+	})
+	plan, err := Load(dir, t.TempDir())
+	if err != nil {
+		t.Fatalf("failed loading problem: %v", err)
+	}
+	if root := plan.RootGroup; !root.IgnoreSample || root.Groups[1].IgnoreSample {
+		t.Errorf("ignore_sample of root %v and secret %v, want only the root", root.IgnoreSample, root.Groups[1].IgnoreSample)
+	}
+}
@@ -0,0 +1,209 @@
+package kattis
+
+import (
+	"fmt"
+	apipb "github.com/jsannemo/omogenexec/api"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// A testDataConfig is the contents of a testdata.yaml file. Settings that a directory does not override are
+// inherited from its parent directory.
+type testDataConfig struct {
+	OnReject             string  `yaml:"on_reject"`
+	Grading              string  `yaml:"grading"`
+	GraderFlags          string  `yaml:"grader_flags"`
+	OutputValidatorFlags string  `yaml:"output_validator_flags"`
+	AcceptScore          float64 `yaml:"accept_score"`
+	RejectScore          float64 `yaml:"reject_score"`
+	Range                string  `yaml:"range"`
+}
+
+func defaultTestDataConfig() testDataConfig {
+	return testDataConfig{
+		OnReject:    "break",
+		Grading:     "default",
+		AcceptScore: 1,
+		RejectScore: 0,
+		Range:       "-inf +inf",
+	}
+}
+
+// loadGroups builds the test group tree rooted in the data directory of a package. It also returns whether any group
+// uses a custom grader.
+func loadGroups(dataPath string, validatorFlags []string) (*apipb.TestGroup, bool, error) {
+	l := &groupLoader{dataPath: dataPath, validatorFlags: validatorFlags}
+	root, err := l.loadGroup(dataPath, defaultTestDataConfig())
+	if err != nil {
+		return nil, false, err
+	}
+	return root, l.customGrading, nil
+}
+
+type groupLoader struct {
+	dataPath       string
+	validatorFlags []string
+	customGrading  bool
+}
+
+func (l *groupLoader) loadGroup(path string, parentConfig testDataConfig) (*apipb.TestGroup, error) {
+	config := parentConfig
+	if err := readYaml(filepath.Join(path, "testdata.yaml"), &config); err != nil {
+		return nil, err
+	}
+	// Only data/sample holds the samples; a group named sample deeper in the tree is an ordinary group.
+	group := &apipb.TestGroup{
+		Name:        filepath.Base(path),
+		IsSample:    path == filepath.Join(l.dataPath, "sample"),
+		AcceptScore: config.AcceptScore,
+		RejectScore: config.RejectScore,
+	}
+	group.OutputValidatorFlags = append(group.OutputValidatorFlags, l.validatorFlags...)
+	group.OutputValidatorFlags = append(group.OutputValidatorFlags, strings.Fields(config.OutputValidatorFlags)...)
+
+	switch config.OnReject {
+	case "break":
+		group.BreakOnFail = true
+	case "continue":
+	default:
+		return nil, fmt.Errorf("invalid on_reject in %s: %s", path, config.OnReject)
+	}
+	scoreRange, err := parseRange(config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid scores in %s: %v", path, err)
+	}
+	// The default range allows any score, so it is left out.
+	if !math.IsInf(scoreRange.Min, -1) || !math.IsInf(scoreRange.Max, 1) {
+		group.ScoreRange = scoreRange
+	}
+
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			subgroup, err := l.loadGroup(filepath.Join(path, name), config)
+			if err != nil {
+				return nil, err
+			}
+			group.Groups = append(group.Groups, subgroup)
+		} else if filepath.Ext(name) == ".in" {
+			tc, err := loadCase(path, strings.TrimSuffix(name, ".in"))
+			if err != nil {
+				return nil, err
+			}
+			group.Cases = append(group.Cases, tc)
+		}
+	}
+
+	switch config.Grading {
+	case "default":
+		inherited := config.GraderFlags == parentConfig.GraderFlags
+		if err := parseGraderFlags(group, strings.Fields(config.GraderFlags), inherited); err != nil {
+			return nil, fmt.Errorf("invalid grader_flags in %s: %v", path, err)
+		}
+	case "custom":
+		group.CustomGrading = true
+		group.GraderFlags = strings.Fields(config.GraderFlags)
+		l.customGrading = true
+	default:
+		return nil, fmt.Errorf("invalid grading in %s: %s", path, config.Grading)
+	}
+	return group, nil
+}
+
+func loadCase(path, name string) (*apipb.TestCase, error) {
+	tc := &apipb.TestCase{
+		Name:       name,
+		InputPath:  filepath.Join(path, name+".in"),
+		OutputPath: filepath.Join(path, name+".ans"),
+	}
+	if _, err := os.Stat(tc.OutputPath); err != nil {
+		return nil, fmt.Errorf("missing answer for test case %s: %v", tc.InputPath, err)
+	}
+	return tc, nil
+}
+
+// parseGraderFlags configures the default grader of a group according to its grader_flags, which may be inherited
+// from its parent directory.
+func parseGraderFlags(group *apipb.TestGroup, flags []string, inherited bool) error {
+	group.VerdictMode = apipb.VerdictMode_WORST_ERROR
+	group.ScoringMode = apipb.ScoringMode_SUM
+	for _, flag := range flags {
+		switch flag {
+		case "first_error":
+			group.VerdictMode = apipb.VerdictMode_FIRST_ERROR
+		case "worst_error":
+			group.VerdictMode = apipb.VerdictMode_WORST_ERROR
+		case "always_accept":
+			group.VerdictMode = apipb.VerdictMode_ALWAYS_ACCEPT
+		case "accept_if_any_accepted":
+			group.AcceptIfAnyAccepted = true
+		case "min":
+			group.ScoringMode = apipb.ScoringMode_MIN
+		case "max":
+			group.ScoringMode = apipb.ScoringMode_MAX
+		case "sum":
+			group.ScoringMode = apipb.ScoringMode_SUM
+		case "avg":
+			group.ScoringMode = apipb.ScoringMode_AVG
+		case "ignore_sample":
+			hasSample := false
+			for _, subgroup := range group.Groups {
+				if subgroup.IsSample {
+					hasSample = true
+				}
+			}
+			// The flag is inherited by the groups below the one setting it, which have no samples to ignore. A group
+			// setting it itself without samples would get a different score than intended.
+			if !hasSample && !inherited {
+				return fmt.Errorf("ignore_sample set on a group without samples")
+			}
+			group.IgnoreSample = hasSample
+		default:
+			return fmt.Errorf("unknown flag %s", flag)
+		}
+	}
+	return nil
+}
+
+// parseRange parses the score range of a group, and verifies that its accept and reject scores lie within it.
+func parseRange(config testDataConfig) (*apipb.ScoreRange, error) {
+	bounds := strings.Fields(config.Range)
+	if len(bounds) != 2 {
+		return nil, fmt.Errorf("range must have two values: %q", config.Range)
+	}
+	lo, err := parseScore(bounds[0])
+	if err != nil {
+		return nil, err
+	}
+	hi, err := parseScore(bounds[1])
+	if err != nil {
+		return nil, err
+	}
+	if lo > hi {
+		return nil, fmt.Errorf("empty range: %q", config.Range)
+	}
+	for _, score := range []float64{config.AcceptScore, config.RejectScore} {
+		if score < lo || score > hi {
+			return nil, fmt.Errorf("score %v outside of range %q", score, config.Range)
+		}
+	}
+	return &apipb.ScoreRange{Min: lo, Max: hi}, nil
+}
+
+func parseScore(s string) (float64, error) {
+	switch s {
+	case "-inf":
+		return math.Inf(-1), nil
+	case "inf", "+inf":
+		return math.Inf(1), nil
+	}
+	return strconv.ParseFloat(s, 64)
+}
@@ -7,6 +7,7 @@ extern crate nix;
 extern crate syscalls;
 mod chroot;
 mod libc_bindings;
+mod protocol;
 mod quota;
 mod sandbox;
 
@@ -62,6 +63,9 @@ struct Opt {
     /// The file system inode quota
     #[clap(long)]
     inodes: u64,
+    /// The maximum size in kilobytes of any file written by the sandboxed process
+    #[clap(long)]
+    file_size_limit_kb: Option<u64>,
     /// The memory limit in megabytes.
     #[clap(long)]
     memory_mb: u64,
@@ -105,6 +109,7 @@ fn main() {
         writable: opt.writable,
         working_directory: PathBuf::from(opt.working_dir),
         mem_limit_bytes: opt.memory_mb as i64 * 1024 * 1024,
+        file_size_limit_bytes: opt.file_size_limit_kb.map(|kb| kb * 1024),
         time_lim: std::time::Duration::from_millis(opt.time_lim_ms),
         wall_time_lim: std::time::Duration::from_millis(opt.wall_time_lim_ms),
         pid_limit: opt.pid_limit,
@@ -0,0 +1,127 @@
+// The protocol used to talk to the process controlling the sandbox over stdin and stdout.
+//
+// Every message is framed by its length in bytes as a 32-bit big-endian integer. The message
+// itself is a list of key-value fields, where each key and value is a string prefixed by its
+// length in the same way. Keys may be repeated, e.g. for the arguments of a command.
+//
+// When the sandbox has started, it sends a handshake message with the protocol version. It then
+// reads one command message at a time, and answers each with a result message. The sandbox exits
+// when its stdin is closed.
+use std::io::{self, Read, Write};
+
+pub const PROTOCOL_VERSION: u32 = 2;
+
+// Messages larger than this are rejected, to avoid allocating arbitrary amounts of memory on a
+// corrupt length.
+const MAX_MESSAGE_BYTES: u32 = 16 * 1024 * 1024;
+
+pub struct Message {
+    fields: Vec<(String, String)>,
+}
+
+impl Message {
+    pub fn new() -> Message {
+        Message { fields: vec![] }
+    }
+
+    pub fn add(&mut self, key: &str, value: String) -> &mut Message {
+        self.fields.push((key.to_string(), value));
+        self
+    }
+
+    pub fn get(&self, key: &str) -> Option<&str> {
+        self.fields
+            .iter()
+            .find(|field| field.0 == key)
+            .map(|field| field.1.as_str())
+    }
+
+    pub fn get_all(&self, key: &str) -> Vec<String> {
+        self.fields
+            .iter()
+            .filter(|field| field.0 == key)
+            .map(|field| field.1.clone())
+            .collect()
+    }
+
+    pub fn get_u64(&self, key: &str) -> Result<Option<u64>, String> {
+        match self.get(key) {
+            None => Ok(None),
+            Some(value) => value
+                .parse::<u64>()
+                .map(Some)
+                .map_err(|err| format!("invalid {}: {:?} ({})", key, value, err)),
+        }
+    }
+}
+
+fn read_u32<R: Read>(r: &mut R) -> io::Result<u32> {
+    let mut buf = [0; 4];
+    r.read_exact(&mut buf)?;
+    Ok(((buf[0] as u32) << 24) | ((buf[1] as u32) << 16) | ((buf[2] as u32) << 8) | (buf[3] as u32))
+}
+
+fn write_u32(buf: &mut Vec<u8>, n: u32) {
+    buf.push((n >> 24) as u8);
+    buf.push((n >> 16) as u8);
+    buf.push((n >> 8) as u8);
+    buf.push(n as u8);
+}
+
+fn take_string(payload: &[u8], at: &mut usize) -> io::Result<String> {
+    let invalid = |msg: &str| io::Error::new(io::ErrorKind::InvalidData, msg.to_string());
+    if payload.len() - *at < 4 {
+        return Err(invalid("truncated field length"));
+    }
+    let len = read_u32(&mut &payload[*at..*at + 4])? as usize;
+    *at += 4;
+    if payload.len() - *at < len {
+        return Err(invalid("truncated field"));
+    }
+    let value = String::from_utf8(payload[*at..*at + len].to_vec())
+        .map_err(|_| invalid("field is not valid UTF-8"))?;
+    *at += len;
+    Ok(value)
+}
+
+// Reads the next message. If the stream ends before a new message starts, None is returned.
+pub fn read_message<R: Read>(r: &mut R) -> io::Result<Option<Message>> {
+    let mut len_buf = [0; 4];
+    let n = r.read(&mut len_buf[..1])?;
+    if n == 0 {
+        return Ok(None);
+    }
+    r.read_exact(&mut len_buf[1..])?;
+    let len = read_u32(&mut &len_buf[..])?;
+    if len > MAX_MESSAGE_BYTES {
+        return Err(io::Error::new(
+            io::ErrorKind::InvalidData,
+            format!("message of {} bytes is too large", len),
+        ));
+    }
+    let mut payload = vec![0; len as usize];
+    r.read_exact(&mut payload)?;
+    let mut msg = Message::new();
+    let mut at = 0;
+    while at < payload.len() {
+        let key = take_string(&payload, &mut at)?;
+        let value = take_string(&payload, &mut at)?;
+        msg.fields.push((key, value));
+    }
+    Ok(Some(msg))
+}
+
+pub fn write_message<W: Write>(w: &mut W, msg: &Message) -> io::Result<()> {
+    let mut payload = vec![];
+    for &(ref key, ref value) in &msg.fields {
+        write_u32(&mut payload, key.len() as u32);
+        payload.extend_from_slice(key.as_bytes());
+        write_u32(&mut payload, value.len() as u32);
+        payload.extend_from_slice(value.as_bytes());
+    }
+    let mut frame = vec![];
+    write_u32(&mut frame, payload.len() as u32);
+    frame.extend(payload);
+    w.write_all(&frame)?;
+    w.flush()
+}
@@ -1,18 +1,21 @@
 use cgroups_rs::*;
 use chroot::{apply_chroot, make_mount, Mount, mount_procfs, read_only_copy_mount};
+use protocol::{read_message, write_message, Message, PROTOCOL_VERSION};
 use libc_bindings::{
     close_nonstd_fds, drop_groups, exec, fclose, FileAccessMode, fork, ForkProcess, gid_t,
     kill, make_closing_pipes, privatize_mounts, repoint_stream, set_kill_on_parent_death, set_res_uid_and_gid,
-    stderr, stdin, stdout, uid_t, wait_any_nohang, wait_for_nohang,
+    set_rlimit, stderr, stdin, stdout, uid_t, wait_any_nohang, wait_for_nohang,
 };
 use std::{
-    fs::File,
-    io::{Read, Write},
+    fs::{File, OpenOptions},
+    io::{Read, Seek, SeekFrom, Write},
     os::unix::io::FromRawFd,
-    path::PathBuf,
+    path::{Path, PathBuf},
     process,
 };
 
+const CGROUP_ROOT_PATH: &str = "/sys/fs/cgroup";
+
 #[derive(Clone)]
 pub struct Context {
     pub sandbox_id: u32,
@@ -27,6 +30,7 @@ pub struct Context {
     pub working_directory: PathBuf,
     pub env: Vec<String>,
     pub mem_limit_bytes: i64,
+    pub file_size_limit_bytes: Option<u64>,
     pub time_lim: std::time::Duration,
     pub wall_time_lim: std::time::Duration,
     pub pid_limit: i64,
@@ -103,48 +107,65 @@ fn parse_mount_path(path: &String) -> (PathBuf, PathBuf) {
     };
 }
 
-fn read_command() -> (String, Vec<String>) {
-    let mut cmds = [0; 1];
-    let n = std::io::stdin().read(&mut cmds[..]).unwrap();
-    if n == 0 {
-        return (String::new(), vec![]);
-    }
-    let mut exec = String::new();
-    let mut args = vec![String::new(); (cmds[0] as usize) - 1];
+// A single command to run in the sandbox, together with the limits that apply to it.
+struct Command {
+    executable: String,
+    args: Vec<String>,
+    env: Vec<String>,
+    mem_limit_bytes: i64,
+    file_size_limit_bytes: Option<u64>,
+    time_lim: std::time::Duration,
+    wall_time_lim: std::time::Duration,
+}
 
-    let mut buffer = [0; 1024];
-    let mut at = 0;
-    // Note: we only support getting one command written at a time.
-    while at < cmds[0] {
-        let mut append = if at == 0 {
-            &mut exec
-        } else {
-            &mut args[(at as usize) - 1]
+// Parses a command message. Limits that are not part of the message default to the ones of the
+// sandbox, and environment variables in the message override those of the sandbox.
+fn parse_command(msg: &Message, ctx: &Context) -> Result<Command, String> {
+    let mut args = msg.get_all("arg");
+    if args.len() == 0 {
+        return Err("command has no executable".to_string());
+    }
+    let executable = args.remove(0);
+    let mut env = ctx.env.clone();
+    for var in msg.get_all("env") {
+        let key = match var.find('=') {
+            None => return Err(format!("invalid environment variable: {:?}", var)),
+            Some(idx) => var[..idx + 1].to_string(),
         };
-        let n = std::io::stdin().read(&mut buffer[..]).unwrap();
-        if n == 0 {
-            eprintln!("command ended unexpectedly");
-            process::exit(1);
-        }
-        for k in 0..n {
-            if buffer[k] == 0 {
-                at += 1;
-                if at == cmds[0] {
-                    break;
-                }
-                append = &mut args[(at as usize) - 1];
-            } else {
-                append.push(buffer[k] as char);
-            }
-        }
+        env.retain(|existing| !existing.starts_with(&key));
+        env.push(var);
     }
-    (exec, args)
+    Ok(Command {
+        executable,
+        args,
+        env,
+        mem_limit_bytes: msg
+            .get_u64("memory_limit_bytes")?
+            .map_or(ctx.mem_limit_bytes, |bytes| bytes as i64),
+        file_size_limit_bytes: msg
+            .get_u64("file_size_limit_bytes")?
+            .or(ctx.file_size_limit_bytes),
+        time_lim: msg
+            .get_u64("time_limit_ms")?
+            .map_or(ctx.time_lim, std::time::Duration::from_millis),
+        wall_time_lim: msg
+            .get_u64("wall_time_limit_ms")?
+            .map_or(ctx.wall_time_lim, std::time::Duration::from_millis),
+    })
+}
+
+fn send(msg: &Message) {
+    let out = std::io::stdout();
+    write_message(&mut out.lock(), msg).unwrap();
+}
+
+fn cgroup_name(ctx: &Context) -> String {
+    format!("omogen-{}", ctx.sandbox_id)
 }
 
 fn setup_cgroups(ctx: &Context) -> Cgroup {
     let hier = cgroups_rs::hierarchies::auto();
-    let cgroup_name = format!("omogen-{}", ctx.sandbox_id);
-    cgroups_rs::cgroup_builder::CgroupBuilder::new(&cgroup_name).build(hier)
+    cgroups_rs::cgroup_builder::CgroupBuilder::new(&cgroup_name(ctx)).build(hier)
 }
 
 pub fn sandbox_main(ctx: Context) -> isize {
@@ -154,17 +175,39 @@ pub fn sandbox_main(ctx: Context) -> isize {
     let cg_cpu: &cgroups_rs::cpu::CpuController = cg.controller_of().unwrap();
     let cg_pid: &cgroups_rs::pid::PidController = cg.controller_of().unwrap();
     cg_mem.set_limit(ctx.mem_limit_bytes).unwrap();
+    let cg_path = Path::new(CGROUP_ROOT_PATH).join(cgroup_name(&ctx));
     setup_container_fs(&ctx);
+    let mut handshake = Message::new();
+    handshake.add("protocol", PROTOCOL_VERSION.to_string());
+    send(&handshake);
 
     loop {
-        let cmd = read_command();
-        if cmd.0.len() == 0 {
-            eprintln!("no more commands, exiting");
-            break;
-        }
+        let msg = {
+            let input = std::io::stdin();
+            read_message(&mut input.lock()).unwrap()
+        };
+        let msg = match msg {
+            None => {
+                eprintln!("no more commands, exiting");
+                break;
+            }
+            Some(msg) => msg,
+        };
+        let cmd = match parse_command(&msg, &ctx) {
+            Ok(cmd) => cmd,
+            Err(err) => {
+                eprintln!("invalid command: {}", err);
+                let mut result = Message::new();
+                result
+                    .add("status", "invalid_command".to_string())
+                    .add("error", err);
+                send(&result);
+                continue;
+            }
+        };
         close_nonstd_fds().unwrap();
         let pipes = make_closing_pipes().unwrap();
-        eprintln!("cmd: {:?} {:?}", cmd.0, cmd.1);
+        eprintln!("cmd: {:?} {:?}", cmd.executable, cmd.args);
         match fork().unwrap() {
             ForkProcess::Child => {
                 apply_chroot(&ctx.container_path, &ctx.working_directory);
@@ -172,7 +215,7 @@ pub fn sandbox_main(ctx: Context) -> isize {
                 set_res_uid_and_gid(ctx.sandbox_uid, ctx.sandbox_gid).unwrap();
                 // Close the read end
                 unsafe { File::from_raw_fd(pipes.0) };
-                setup_and_run(pipes.1, cmd.0, cmd.1, &ctx);
+                setup_and_run(pipes.1, &cmd, &ctx);
                 process::exit(1);
             }
             ForkProcess::Parent(child) => {
@@ -183,6 +226,7 @@ pub fn sandbox_main(ctx: Context) -> isize {
                 let mut err_file = unsafe { File::from_raw_fd(err_pipe) };
                 let mut s = String::new();
                 cg_pid.set_pid_max(MaxValue::Value(ctx.pid_limit)).unwrap();
+                cg_mem.set_limit(cmd.mem_limit_bytes).unwrap();
                 cg_mem.add_task(&CgroupPid::from(child as u64)).unwrap();
                 cg_cpu.add_task(&CgroupPid::from(child as u64)).unwrap();
                 cg_pid.add_task(&CgroupPid::from(child as u64)).unwrap();
@@ -190,25 +234,35 @@ pub fn sandbox_main(ctx: Context) -> isize {
                 // write of pipes block on the corresponding read.
                 let now = std::time::SystemTime::now();
                 err_file.read_to_string(&mut s).unwrap();
+                let mut result = Message::new();
                 if s != "ok" {
-                    println!("killed setup");
-                    println!("done");
+                    result.add("status", "setup_failed".to_string());
+                    send(&result);
                     continue;
                 }
                 let mut sleep = 5;
                 let cpu_before = cpu_stat_nanos(cg_cpu.cpu().stat);
+                let oom_kills_before = oom_kills(&cg_path);
+                let pid_limit_hits_before = pid_limit_hits(&cg_path);
+                let mut mem = MemoryTracker::new(&cg_path);
+                let mut wall_killed = false;
                 loop {
                     let maybe_exit = wait_for_nohang(child).unwrap();
                     match maybe_exit {
                         None => {
+                            mem.sample();
                             let cpu_nanos = cpu_stat_nanos(cg_cpu.cpu().stat) - cpu_before;
                             let cpu_time = std::time::Duration::new(
                                 cpu_nanos / 1_000_000_000,
                                 (cpu_nanos % 1_000_000_000) as u32,
                             );
                             let wall_time = now.elapsed().unwrap();
+                            if wall_time > cmd.wall_time_lim {
+                                wall_killed = true;
+                                break;
+                            }
                             // Wait 1 extra second of CPU time for displaying close calls to judges
-                            if wall_time > ctx.wall_time_lim || cpu_time > ctx.time_lim + std::time::Duration::from_secs(1) {
+                            if cpu_time > cmd.time_lim + std::time::Duration::from_secs(1) {
                                 break;
                             }
                             std::thread::sleep(std::time::Duration::from_millis(sleep));
@@ -223,17 +277,26 @@ pub fn sandbox_main(ctx: Context) -> isize {
                                 process::exit(1);
                             } else {
                                 if libc::WIFEXITED(exit) {
-                                    println!("code {:?}", libc::WEXITSTATUS(exit));
+                                    result
+                                        .add("status", "exited".to_string())
+                                        .add("code", libc::WEXITSTATUS(exit).to_string());
                                 } else if libc::WIFSIGNALED(exit) {
-                                    println!("signal {:?}", libc::WTERMSIG(exit));
+                                    result
+                                        .add("status", "signaled".to_string())
+                                        .add("signal", libc::WTERMSIG(exit).to_string());
                                 } else if libc::WIFSTOPPED(exit) {
-                                    println!("signal {:?}", libc::WSTOPSIG(exit));
+                                    result
+                                        .add("status", "signaled".to_string())
+                                        .add("signal", libc::WSTOPSIG(exit).to_string());
                                 }
                             }
                             break;
                         }
                     }
                 }
+                let wall_time = now.elapsed().unwrap();
+                // Read before freezing the cgroup, which itself makes forks fail.
+                let pid_hits = pid_limit_hits(&cg_path) - pid_limit_hits_before;
                 eprintln!("finished command, freezing cgroup");
                 // Make sure no new pids can be created to kill fork bombs
                 cg_pid.set_pid_max(MaxValue::Value(0)).unwrap();
@@ -267,15 +330,30 @@ pub fn sandbox_main(ctx: Context) -> isize {
                     cpu_nanos / 1_000_000_000,
                     (cpu_nanos % 1_000_000_000) as u32,
                 );
-                if cpu_time > ctx.time_lim {
-                    println!("killed tle");
+                if result.get("status").is_none() {
+                    // The command was killed by us before it exited.
+                    result.add("status", "signaled".to_string()).add("signal", libc::SIGKILL.to_string());
+                }
+                if cpu_time > cmd.time_lim {
+                    result.add("killed", "tle".to_string());
+                } else if oom_kills(&cg_path) > oom_kills_before {
+                    result.add("killed", "mle".to_string());
+                } else if wall_killed {
+                    // The command used little CPU time but still ran out of time, e.g. because it
+                    // was sleeping or blocked on input.
+                    result.add("killed", "wall".to_string());
                 }
                 // Nanos -> Millis
-                println!("cpu {:?}", cpu_nanos / 1_000_000);
-                println!("done");
+                result.add("cpu_ms", (cpu_nanos / 1_000_000).to_string());
+                result.add("wall_ms", wall_time.as_millis().to_string());
+                result.add("mem_bytes", mem.peak_bytes().to_string());
+                if pid_hits > 0 {
+                    result.add("pid_limit_hits", pid_hits.to_string());
+                }
+                send(&result);
             }
         }
-        eprintln!("done with cmd: {:?} {:?}", cmd.0, cmd.1);
+        eprintln!("done with cmd: {:?} {:?}", cmd.executable, cmd.args);
     }
     cg.delete().unwrap();
     0
@@ -296,7 +374,77 @@ fn cpu_stat_nanos(stat: String) -> u64 {
     panic!("cpu.stat doesn't have usage_usec!?")
 }
 
-fn set_streams(ctx: &Context) -> Result<(), String> {
+fn read_cgroup_u64(path: &Path) -> Option<u64> {
+    std::fs::read_to_string(path).ok()?.trim().parse::<u64>().ok()
+}
+
+// Reads a counter from one of the flat-keyed events files of the cgroup.
+fn cgroup_event_count(cg_path: &Path, file: &str, key: &str) -> u64 {
+    let events = std::fs::read_to_string(cg_path.join(file)).unwrap_or_default();
+    for line in events.split("\n") {
+        let fields: Vec<&str> = line.split(' ').collect();
+        if fields.len() == 2 && fields[0] == key {
+            return fields[1].parse::<u64>().unwrap_or(0);
+        }
+    }
+    0
+}
+
+fn oom_kills(cg_path: &Path) -> u64 {
+    cgroup_event_count(cg_path, "memory.events", "oom_kill")
+}
+
+// The number of times a process in the cgroup failed to fork because of the pid limit.
+fn pid_limit_hits(cg_path: &Path) -> u64 {
+    cgroup_event_count(cg_path, "pids.events", "max")
+}
+
+// Keeps track of the peak memory usage of the cgroup during a single command.
+//
+// memory.peak is only resettable (per open file) on newer kernels, so on older kernels we fall back
+// to sampling memory.current while the command is running.
+struct MemoryTracker {
+    peak_file: Option<File>,
+    current_path: PathBuf,
+    sampled_peak: u64,
+}
+
+impl MemoryTracker {
+    fn new(cg_path: &Path) -> MemoryTracker {
+        let peak_file = OpenOptions::new()
+            .read(true)
+            .write(true)
+            .open(cg_path.join("memory.peak"))
+            .ok()
+            .and_then(|mut file| file.write_all(b"reset\n").ok().map(|_| file));
+        MemoryTracker {
+            peak_file,
+            current_path: cg_path.join("memory.current"),
+            sampled_peak: 0,
+        }
+    }
+
+    fn sample(&mut self) {
+        if let Some(current) = read_cgroup_u64(&self.current_path) {
+            self.sampled_peak = std::cmp::max(self.sampled_peak, current);
+        }
+    }
+
+    fn peak_bytes(&mut self) -> u64 {
+        let mut peak = self.sampled_peak;
+        if let Some(file) = self.peak_file.as_mut() {
+            let mut contents = String::new();
+            if file.seek(SeekFrom::Start(0)).is_ok() && file.read_to_string(&mut contents).is_ok() {
+                if let Ok(file_peak) = contents.trim().parse::<u64>() {
+                    peak = std::cmp::max(peak, file_peak);
+                }
+            }
+        }
+        peak
+    }
+}
+
+fn set_streams(cmd: &Command, ctx: &Context) -> Result<(), String> {
     unsafe {
         if ctx.stdin.len() == 0 {
             fclose(stdin)?;
@@ -314,18 +462,22 @@ fn set_streams(ctx: &Context) -> Result<(), String> {
             repoint_stream(ctx.stderr.to_string(), stderr, FileAccessMode::Writable)?;
         }
     }
+    if let Some(limit) = cmd.file_size_limit_bytes {
+        // Writing past the limit raises SIGXFSZ, which the Go wrapper reports as an exceeded output limit.
+        set_rlimit(libc::RLIMIT_FSIZE, limit, limit)?;
+    }
     Ok(())
 }
 
-fn setup_and_run(err_pipe: i32, cmd: String, args: Vec<String>, ctx: &Context) {
+fn setup_and_run(err_pipe: i32, cmd: &Command, ctx: &Context) {
     let mut err_file = unsafe { File::from_raw_fd(err_pipe) };
-    set_streams(ctx).unwrap_or_else(|err| {
+    set_streams(cmd, ctx).unwrap_or_else(|err| {
         eprintln!("setup error: {:?}", err);
         write!(&mut err_file, "err").unwrap();
         process::exit(1);
     });
     write!(&mut err_file, "ok").unwrap();
-    exec(cmd.clone(), args.clone(), ctx.env.clone()).unwrap_or_else(|err| {
+    exec(cmd.executable.clone(), cmd.args.clone(), cmd.env.clone()).unwrap_or_else(|err| {
         eprintln!("{:?}", err);
         write!(&mut err_file, "exec").unwrap();
         process::exit(1);
@@ -0,0 +1,203 @@
+// Package server implements the RunnerService, which lets remote clients compile and evaluate programs on the host.
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/logger"
+	apipb "github.com/jsannemo/omogenexec/api"
+	"github.com/jsannemo/omogenexec/eval"
+	"github.com/jsannemo/omogenexec/util"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+type runnerServer struct {
+	apipb.UnimplementedRunnerServiceServer
+	root string
+	// The directory that the paths of test cases in evaluation plans are relative to.
+	dataRoot string
+	// session is a random prefix of the directory names used by this server, so that they do not collide with those
+	// of an earlier server using the same root.
+	session string
+	next    uint64
+}
+
+// NewRunnerServer returns a RunnerService that stores compiled programs and evaluation environments below the given
+// root directory, and reads test data from below the given data directory.
+//
+// Clients only refer to files on the host by paths relative to these directories: the program roots of compiled
+// programs are relative to the directory of compiled programs, and the paths of test cases are relative to the data
+// directory. Absolute paths and paths leaving their directory are rejected.
+//
+// Compiled programs are kept until they are removed from the host, since clients may evaluate them any number of
+// times. Evaluation environments are removed once the evaluation is done.
+func NewRunnerServer(root, dataRoot string) (apipb.RunnerServiceServer, error) {
+	for _, dir := range []string{"programs", "evals"} {
+		fb := util.NewFileBase(filepath.Join(root, dir))
+		fb.OwnerGid = util.OmogenexecGroupId()
+		if err := fb.Mkdir("."); err != nil {
+			return nil, fmt.Errorf("failed creating %s directory: %v", dir, err)
+		}
+	}
+	return &runnerServer{
+		root:     root,
+		dataRoot: dataRoot,
+		session:  util.RandStr(8),
+	}, nil
+}
+
+// resolvePath returns the path on the host of a path relative to a directory.
+func resolvePath(dir, path string) (string, error) {
+	if path == "" {
+		return "", fmt.Errorf("empty path")
+	}
+	if filepath.IsAbs(path) {
+		return "", fmt.Errorf("path %s is absolute", path)
+	}
+	for _, part := range strings.Split(filepath.ToSlash(path), "/") {
+		if part == ".." {
+			return "", fmt.Errorf("path %s leaves its directory", path)
+		}
+	}
+	return filepath.Join(dir, path), nil
+}
+
+// resolvePlan replaces the paths in an evaluation plan by the paths on the host they refer to.
+func (s *runnerServer) resolvePlan(plan *apipb.EvaluationPlan) error {
+	for _, program := range []*apipb.CompiledProgram{plan.Program, plan.Validator, plan.Grader} {
+		if program == nil {
+			continue
+		}
+		root, err := resolvePath(filepath.Join(s.root, "programs"), program.ProgramRoot)
+		if err != nil {
+			return fmt.Errorf("invalid program root: %v", err)
+		}
+		program.ProgramRoot = root
+	}
+	if plan.RootGroup == nil {
+		return nil
+	}
+	return s.resolveGroup(plan.RootGroup)
+}
+
+func (s *runnerServer) resolveGroup(tg *apipb.TestGroup) error {
+	for _, tc := range tg.Cases {
+		var err error
+		if tc.InputPath, err = resolvePath(s.dataRoot, tc.InputPath); err != nil {
+			return fmt.Errorf("invalid input of test case %s: %v", tc.Name, err)
+		}
+		if tc.OutputPath, err = resolvePath(s.dataRoot, tc.OutputPath); err != nil {
+			return fmt.Errorf("invalid answer of test case %s: %v", tc.Name, err)
+		}
+	}
+	for _, group := range tg.Groups {
+		if err := s.resolveGroup(group); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newPath returns a new, unused, path in the given directory of the root.
+func (s *runnerServer) newPath(dir string) string {
+	id := atomic.AddUint64(&s.next, 1)
+	return filepath.Join(s.root, dir, fmt.Sprintf("%s-%d", s.session, id))
+}
+
+func (s *runnerServer) Compile(ctx context.Context, program *apipb.Program) (*apipb.CompileResponse, error) {
+	if _, found := eval.GetLanguages()[program.Language]; !found {
+		return nil, status.Errorf(codes.InvalidArgument, "unsupported language %v", program.Language)
+	}
+	for _, file := range program.Sources {
+		if _, err := resolvePath(".", file.Path); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid source file: %v", err)
+		}
+	}
+	dir := s.newPath("programs")
+	compilation, err := eval.CompileContext(ctx, program, dir)
+	if err != nil {
+		return nil, statusFromError("compilation failed", err)
+	}
+	if compilation.Program != nil {
+		// Clients refer to the program by its directory among the compiled programs.
+		compilation.Program.ProgramRoot = filepath.Base(dir)
+	}
+	return &apipb.CompileResponse{
+		Program:        compilation.Program,
+		CompilerErrors: compilation.CompilerErrors,
+	}, nil
+}
+
+func (s *runnerServer) Evaluate(plan *apipb.EvaluationPlan, stream apipb.RunnerService_EvaluateServer) error {
+	plan = proto.Clone(plan).(*apipb.EvaluationPlan)
+	if err := s.resolvePlan(plan); err != nil {
+		return status.Errorf(codes.InvalidArgument, "invalid plan: %v", err)
+	}
+	// The evaluator resets the permissions of the parent of its root, so every evaluation gets a parent of its own
+	// rather than sharing the evals directory with concurrent evaluations.
+	dir := s.newPath("evals")
+	root := filepath.Join(dir, "eval")
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			logger.Warningf("failed removing evaluation environment %s: %v", dir, err)
+		}
+	}()
+	results := make(chan *apipb.Result)
+	evaluator, err := eval.NewEvaluator(root, plan, results)
+	if err != nil {
+		return statusFromError("failed creating evaluator", err)
+	}
+
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+	evalErr := make(chan error, 1)
+	go func() {
+		evalErr <- evaluator.EvaluateContext(ctx)
+	}()
+	var sendErr error
+	for res := range results {
+		if sendErr != nil {
+			continue
+		}
+		if err := stream.Send(res); err != nil {
+			// The client is gone, so there is no point in finishing the evaluation.
+			sendErr = err
+			cancel()
+		}
+	}
+	if err := <-evalErr; sendErr == nil && err != nil {
+		return statusFromError("evaluation failed", err)
+	}
+	return sendErr
+}
+
+func (s *runnerServer) ListLanguages(context.Context, *apipb.ListLanguagesRequest) (*apipb.ListLanguagesResponse, error) {
+	res := &apipb.ListLanguagesResponse{}
+	for _, lang := range eval.GetLanguages() {
+		res.Languages = append(res.Languages, lang.Info)
+	}
+	sort.Slice(res.Languages, func(i, j int) bool {
+		return res.Languages[i].Group < res.Languages[j].Group
+	})
+	return res, nil
+}
+
+func statusFromError(msg string, err error) error {
+	code := codes.Internal
+	if errors.Is(err, eval.ErrCancelled) {
+		code = codes.Canceled
+	} else if errors.Is(err, eval.ErrSandboxesExhausted) {
+		code = codes.ResourceExhausted
+	} else if errors.Is(err, eval.ErrIncompatibleSandbox) {
+		code = codes.FailedPrecondition
+	}
+	return status.Errorf(code, "%s: %v", msg, err)
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	apipb "github.com/jsannemo/omogenexec/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+)
+
+func TestEvaluateRejectsPathsOutsideRoot(t *testing.T) {
+	s := &runnerServer{root: "/runner", dataRoot: "/data"}
+	program := &apipb.CompiledProgram{ProgramRoot: "abc-1"}
+	tests := []struct {
+		name string
+		plan *apipb.EvaluationPlan
+	}{
+		{"absolute input", &apipb.EvaluationPlan{Program: program, RootGroup: &apipb.TestGroup{
+			Cases: []*apipb.TestCase{{Name: "1", InputPath: "/etc/shadow", OutputPath: "1.ans"}}}}},
+		{"input leaving data root", &apipb.EvaluationPlan{Program: program, RootGroup: &apipb.TestGroup{
+			Groups: []*apipb.TestGroup{{Cases: []*apipb.TestCase{{Name: "1", InputPath: "1.in", OutputPath: "a/../../1.ans"}}}}}}},
+		{"program root leaving programs", &apipb.EvaluationPlan{Program: &apipb.CompiledProgram{ProgramRoot: "../evals"}}},
+		{"absolute validator", &apipb.EvaluationPlan{Program: program, Validator: &apipb.CompiledProgram{ProgramRoot: "/bin"}}},
+	}
+	for _, tt := range tests {
+		// The plan is rejected before anything is sent on the stream.
+		err := s.Evaluate(tt.plan, nil)
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%s: Evaluate = %v; want InvalidArgument", tt.name, err)
+		}
+	}
+}
+
+func TestResolvePlan(t *testing.T) {
+	s := &runnerServer{root: "/runner", dataRoot: "/data"}
+	tc := &apipb.TestCase{Name: "1", InputPath: "p/1.in", OutputPath: "p/1.ans"}
+	plan := &apipb.EvaluationPlan{
+		Program:   &apipb.CompiledProgram{ProgramRoot: "abc-1"},
+		RootGroup: &apipb.TestGroup{Groups: []*apipb.TestGroup{{Cases: []*apipb.TestCase{tc}}}},
+	}
+	if err := s.resolvePlan(plan); err != nil {
+		t.Fatalf("resolvePlan: %v", err)
+	}
+	if plan.Program.ProgramRoot != "/runner/programs/abc-1" {
+		t.Errorf("program root %s, want /runner/programs/abc-1", plan.Program.ProgramRoot)
+	}
+	if tc.InputPath != "/data/p/1.in" || tc.OutputPath != "/data/p/1.ans" {
+		t.Errorf("test case paths %s and %s, want /data/p/1.in and /data/p/1.ans", tc.InputPath, tc.OutputPath)
+	}
+}